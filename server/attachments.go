@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxUploadSize = 10 << 20 // 10 MiB
+
+	// Attachments a single message may carry.
+	maxAttachmentsPerMessage = 10
+)
+
+// allowedUploadTypes are the media types accepted for upload, as sniffed
+// from the content rather than trusted from the client.
+var allowedUploadTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+	"text/plain":      true,
+}
+
+var errInvalidAttachment = errors.New("invalid attachment")
+
+// BlobStore holds attachment contents. Keys are opaque names chosen by the
+// server. The local filesystem store is the default; an S3-compatible store
+// only needs to implement these three methods.
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader) error
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+var blobs BlobStore
+
+// localBlobStore keeps each blob as a file under dir.
+type localBlobStore struct {
+	dir string
+}
+
+func newLocalBlobStore(dir string) *localBlobStore {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		log.Fatal("Blob store init failed:", err)
+	}
+	return &localBlobStore{dir: dir}
+}
+
+func (s *localBlobStore) path(key string) (string, error) {
+	if key == "" || strings.ContainsAny(key, `/\`) || key == "." || key == ".." {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(s.dir, key), nil
+}
+
+func (s *localBlobStore) Put(ctx context.Context, key string, r io.Reader) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary name first so a failed upload never leaves a
+	// truncated blob behind under the real key.
+	tmp, err := os.CreateTemp(s.dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *localBlobStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func (s *localBlobStore) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Attachment is an uploaded file. It belongs to its uploader until it is
+// sent with a message.
+type Attachment struct {
+	ID         uint   `gorm:"primaryKey"`
+	UploaderID uint   `gorm:"index;not null"`
+	MessageID  *uint  `gorm:"index"`
+	Key        string `gorm:"uniqueIndex;not null"`
+	Filename   string
+	MIME       string
+	Size       int64
+	CreatedAt  time.Time
+}
+
+type attachmentView struct {
+	ID       uint   `json:"id"`
+	Filename string `json:"filename"`
+	MIME     string `json:"mime"`
+	Size     int64  `json:"size"`
+	URL      string `json:"url"`
+}
+
+func attachmentViews(list []Attachment) []attachmentView {
+	views := make([]attachmentView, 0, len(list))
+	for _, a := range list {
+		views = append(views, attachmentView{
+			ID:       a.ID,
+			Filename: a.Filename,
+			MIME:     a.MIME,
+			Size:     a.Size,
+			URL:      "/attachments/" + strconv.FormatUint(uint64(a.ID), 10),
+		})
+	}
+	return views
+}
+
+// messageAttachments loads the attachments of each message.
+func messageAttachments(messageIDs []uint) map[uint][]Attachment {
+	byMessage := make(map[uint][]Attachment)
+	if len(messageIDs) == 0 {
+		return byMessage
+	}
+
+	list, _ := store.MessageAttachments(messageIDs)
+	for _, a := range list {
+		byMessage[*a.MessageID] = append(byMessage[*a.MessageID], a)
+	}
+	return byMessage
+}
+
+// pendingAttachments loads attachments the client uploaded and hasn't sent
+// yet, reporting an error frame if any ID doesn't qualify.
+func pendingAttachments(client *Client, ids []uint) ([]Attachment, bool) {
+	if len(ids) > maxAttachmentsPerMessage {
+		sendError(client, "invalid_attachment", "Too many attachments")
+		return nil, false
+	}
+
+	list, err := store.PendingAttachments(client.UserID, ids)
+	if err != nil || len(list) != len(ids) {
+		sendError(client, "invalid_attachment", "Unknown or already sent attachment")
+		return nil, false
+	}
+	return list, true
+}
+
+func deleteBlobs(keys []string) {
+	for _, key := range keys {
+		if err := blobs.Delete(context.Background(), key); err != nil {
+			log.Printf("delete blob %s: %v", key, err)
+		}
+	}
+}
+
+// ================= ATTACHMENT HANDLERS =================
+
+// uploadHandler serves POST /attachments with a multipart "file" field. The
+// returned ID can then be sent in a message's attachments list.
+func uploadHandler(w http.ResponseWriter, r *http.Request, user User) {
+	// Leave room for the multipart framing around the file.
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize+1<<20)
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "File required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	if header.Size > maxUploadSize {
+		http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	sniff := make([]byte, 512)
+	n, err := io.ReadFull(file, sniff)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		http.Error(w, "Could not read file", http.StatusBadRequest)
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(sniff[:n]))
+	if !allowedUploadTypes[mediaType] {
+		http.Error(w, "File type not allowed", http.StatusUnsupportedMediaType)
+		return
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, "Could not read file", http.StatusInternalServerError)
+		return
+	}
+
+	key, err := randomToken()
+	if err != nil {
+		http.Error(w, "Upload failed", http.StatusInternalServerError)
+		return
+	}
+	if err := blobs.Put(r.Context(), key, file); err != nil {
+		http.Error(w, "Upload failed", http.StatusInternalServerError)
+		return
+	}
+
+	attachment := Attachment{
+		UploaderID: user.ID,
+		Key:        key,
+		Filename:   filepath.Base(header.Filename),
+		MIME:       mediaType,
+		Size:       header.Size,
+	}
+	if err := store.CreateAttachment(&attachment); err != nil {
+		blobs.Delete(r.Context(), key)
+		http.Error(w, "Upload failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(attachmentViews([]Attachment{attachment})[0])
+}
+
+// downloadHandler serves GET /attachments/{id} to the uploader and, once
+// sent, to everyone who can see the message.
+func downloadHandler(w http.ResponseWriter, r *http.Request, user User) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid attachment id", http.StatusBadRequest)
+		return
+	}
+
+	a, err := store.Attachment(uint(id))
+	if err != nil || !canViewAttachment(user.ID, a) {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+
+	blob, err := blobs.Open(r.Context(), a.Key)
+	if err != nil {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+	defer blob.Close()
+
+	disposition := "attachment"
+	if strings.HasPrefix(a.MIME, "image/") {
+		disposition = "inline"
+	}
+
+	w.Header().Set("Content-Type", a.MIME)
+	w.Header().Set("Content-Length", strconv.FormatInt(a.Size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": a.Filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	io.Copy(w, blob)
+}
+
+func canViewAttachment(userID uint, a Attachment) bool {
+	if a.UploaderID == userID {
+		return true
+	}
+	if a.MessageID == nil {
+		return false
+	}
+
+	m, err := store.Message(*a.MessageID)
+	if err != nil {
+		return false
+	}
+	return canViewMessage(userID, m)
+}
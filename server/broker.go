@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Broker carries events between the hubs of every server node, so users
+// connected to different instances behind a load balancer can reach each
+// other. Payloads are opaque to the broker.
+type Broker interface {
+	// Publish sends payload to every subscriber, the publisher's own
+	// included.
+	Publish(payload []byte) error
+	// Subscribe registers fn to be called with each published payload, in
+	// publication order.
+	Subscribe(fn func(payload []byte))
+	Close() error
+}
+
+// openBroker connects to the configured broker. The memory broker keeps a
+// single node to itself.
+func openBroker(c brokerConfig) (Broker, error) {
+	switch c.Driver {
+	case "", "memory":
+		return newMemoryBroker(), nil
+	case "postgres":
+		return newPostgresBroker(c.DSN)
+	default:
+		return nil, fmt.Errorf("unknown broker driver %q", c.Driver)
+	}
+}
+
+// memoryBroker delivers payloads in-process. Hubs sharing one behave like
+// separate nodes.
+type memoryBroker struct {
+	mu   sync.Mutex
+	subs []func([]byte)
+}
+
+func newMemoryBroker() *memoryBroker {
+	return &memoryBroker{}
+}
+
+func (b *memoryBroker) Publish(payload []byte) error {
+	b.mu.Lock()
+	subs := b.subs
+	b.mu.Unlock()
+
+	for _, fn := range subs {
+		fn(payload)
+	}
+	return nil
+}
+
+func (b *memoryBroker) Subscribe(fn func([]byte)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs = append(b.subs, fn)
+}
+
+// Close is a no-op; there is nothing to release.
+func (b *memoryBroker) Close() error {
+	return nil
+}
+
+// ================= EVENTS =================
+
+// Kinds of busEvent.
+const (
+	busDeliver    = "deliver"    // a frame for users on every node
+	busPresence   = "presence"   // changes to the sender's local presence
+	busSync       = "sync"       // the sender's full local presence; also a heartbeat
+	busHello      = "hello"      // a node started and wants everyone's sync
+	busBye        = "bye"        // a node is shutting down
+	busDisconnect = "disconnect" // close every session of a refresh family
+)
+
+const (
+	// Every node publishes its presence this often so the others can
+	// notice when it disappears without saying goodbye.
+	presenceSyncInterval = 15 * time.Second
+
+	// A node not heard from for this long is dropped, along with the
+	// presence of its users.
+	nodeTimeout = 3 * presenceSyncInterval
+)
+
+// busEvent is what hubs exchange through the broker.
+type busEvent struct {
+	Node string `json:"node"`
+	Kind string `json:"kind"`
+
+	// deliver
+	Frame    json.RawMessage `json:"frame,omitempty"`
+	Envelope json.RawMessage `json:"envelope,omitempty"`
+	Users    []uint          `json:"users,omitempty"` // empty means everyone
+	Except   uint            `json:"except,omitempty"`
+
+	// presence and sync
+	Presence []nodePresence `json:"presence,omitempty"`
+
+	// disconnect
+	Family string `json:"family,omitempty"`
+	Reason string `json:"reason,omitempty"`
+
+	flushed chan struct{} // set on a local marker that is never published
+}
+
+// nodePresence is one user's state across the sessions of a single node.
+type nodePresence struct {
+	UserID   uint   `json:"user_id"`
+	Username string `json:"username"`
+	State    string `json:"state"`
+}
+
+// remoteNode is what a hub knows about another node.
+type remoteNode struct {
+	users map[uint]nodePresence
+	seen  time.Time
+}
+
+func newNodeID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// ================= NODES =================
+
+// busEvent describes d for the other nodes. Only deliveries without a match
+// function can be published.
+func (d delivery) busEvent() busEvent {
+	return busEvent{Kind: busDeliver, Frame: d.frame.flat, Envelope: d.frame.envelope, Users: d.users, Except: d.except}
+}
+
+// publish queues ev for the broker. It may be called from any goroutine,
+// the hub's included, and never waits on the network.
+func (h *Hub) publish(ev busEvent) {
+	ev.Node = h.node
+	h.outbox <- ev
+}
+
+// publishLoop hands queued events to the broker in order.
+func (h *Hub) publishLoop() {
+	for ev := range h.outbox {
+		if ev.flushed != nil {
+			close(ev.flushed)
+			continue
+		}
+		if err := h.broker.Publish(mustEncode(ev)); err != nil {
+			log.Println("Broker: publish:", err)
+		}
+	}
+}
+
+// flush waits until everything queued so far has been published.
+func (h *Hub) flush(ctx context.Context) error {
+	done := make(chan struct{})
+	select {
+	case h.outbox <- busEvent{flushed: done}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// leaveCluster tells the other nodes this one is going away, so they drop
+// its users at once instead of waiting for it to time out, and closes the
+// broker.
+func (h *Hub) leaveCluster(ctx context.Context) error {
+	h.publish(busEvent{Kind: busBye})
+	if err := h.flush(ctx); err != nil {
+		return err
+	}
+	return h.broker.Close()
+}
+
+// receive is the hub's broker subscription. It runs on the broker's
+// goroutine and passes other nodes' events to the hub.
+func (h *Hub) receive(payload []byte) {
+	var ev busEvent
+	if err := json.Unmarshal(payload, &ev); err != nil {
+		log.Println("Broker: bad event:", err)
+		return
+	}
+	if ev.Node == h.node {
+		return
+	}
+	h.inbound <- ev
+}
+
+// handleRemote applies an event from another node. It runs on the hub
+// goroutine.
+func (h *Hub) handleRemote(ev busEvent) {
+	if ev.Kind == busBye {
+		h.dropNode(ev.Node)
+		return
+	}
+
+	n := h.remote[ev.Node]
+	if n == nil {
+		n = &remoteNode{users: make(map[uint]nodePresence)}
+		h.remote[ev.Node] = n
+	}
+	n.seen = time.Now()
+
+	switch ev.Kind {
+	case busDeliver:
+		h.dispatch(delivery{
+			frame:  encodedEvent{flat: ev.Frame, envelope: ev.Envelope},
+			users:  ev.Users,
+			except: ev.Except,
+		})
+
+	case busPresence:
+		for _, p := range ev.Presence {
+			h.setRemotePresence(n, p)
+		}
+
+	case busSync:
+		listed := make(map[uint]bool, len(ev.Presence))
+		for _, p := range ev.Presence {
+			listed[p.UserID] = true
+			h.setRemotePresence(n, p)
+		}
+		for id, p := range n.users {
+			if !listed[id] {
+				p.State = presenceOffline
+				h.setRemotePresence(n, p)
+			}
+		}
+
+	case busHello:
+		h.publish(h.syncEvent())
+
+	case busDisconnect:
+		var matched []*Client
+		for c := range h.clients {
+			if c.Family == ev.Family {
+				matched = append(matched, c)
+			}
+		}
+		// Closing writes to the sockets, which mustn't hold up the hub.
+		go func() {
+			for _, c := range matched {
+				c.disconnect(ev.Reason)
+			}
+		}()
+	}
+}
+
+// setRemotePresence records a user's state on node n and announces any
+// change to their overall state.
+func (h *Hub) setRemotePresence(n *remoteNode, p nodePresence) {
+	before := h.presence(p.UserID)
+	if p.State == presenceOffline {
+		delete(n.users, p.UserID)
+	} else {
+		n.users[p.UserID] = p
+	}
+	h.announcePresence(p.Username, before, h.presence(p.UserID))
+}
+
+// dropNode forgets a node and the presence of its users.
+func (h *Hub) dropNode(id string) {
+	n := h.remote[id]
+	if n == nil {
+		return
+	}
+	for _, p := range n.users {
+		p.State = presenceOffline
+		h.setRemotePresence(n, p)
+	}
+	delete(h.remote, id)
+}
+
+// expireNodes drops nodes that have stopped syncing.
+func (h *Hub) expireNodes(now time.Time) {
+	for id, n := range h.remote {
+		if now.Sub(n.seen) > nodeTimeout {
+			log.Printf("Broker: node %s timed out", id)
+			h.dropNode(id)
+		}
+	}
+}
+
+// syncEvent describes the presence of every user connected to this node.
+func (h *Hub) syncEvent() busEvent {
+	ev := busEvent{Kind: busSync}
+	for id, set := range h.sessions {
+		for c := range set {
+			ev.Presence = append(ev.Presence, nodePresence{UserID: id, Username: c.Username, State: h.localPresence(id)})
+			break
+		}
+	}
+	return ev
+}
+
+// onlineUsers lists every user connected to any node, once each. It runs on
+// the hub goroutine.
+func (h *Hub) onlineUsers() []string {
+	seen := make(map[uint]bool)
+	list := []string{}
+	for id, set := range h.sessions {
+		for c := range set {
+			seen[id] = true
+			list = append(list, c.Username)
+			break
+		}
+	}
+	for _, n := range h.remote {
+		for id, p := range n.users {
+			if !seen[id] {
+				seen[id] = true
+				list = append(list, p.Username)
+			}
+		}
+	}
+	return list
+}
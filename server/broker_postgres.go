@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	notifyChannel = "chatapp_events"
+
+	// NOTIFY payloads must stay under 8000 bytes. Larger ones are parked in
+	// a table and only their ID is sent, prefixed with '@'.
+	maxNotifyPayload = 7900
+
+	// Parked payloads are deleted once every listener has had time to read
+	// them.
+	parkedPayloadTTL = time.Minute
+
+	// Delay before the listener reconnects after losing its connection.
+	listenRetry = 2 * time.Second
+)
+
+// postgresBroker relays payloads between nodes with LISTEN/NOTIFY, so a
+// deployment that already runs Postgres needs nothing else. Notifications
+// sent while a node's listener is reconnecting are lost to it; presence
+// recovers with the next sync.
+type postgresBroker struct {
+	dsn  string
+	pool *pgxpool.Pool
+
+	mu   sync.Mutex
+	subs []func([]byte)
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newPostgresBroker(dsn string) (*postgresBroker, error) {
+	ctx := context.Background()
+
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		return nil, err
+	}
+	_, err = pool.Exec(ctx, `CREATE TABLE IF NOT EXISTS broker_payloads (
+		id bigserial PRIMARY KEY,
+		payload text NOT NULL,
+		created_at timestamptz NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	// Connect the listener up front so a bad DSN fails at startup.
+	conn, err := listen(ctx, dsn)
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	b := &postgresBroker{dsn: dsn, pool: pool, cancel: cancel, done: make(chan struct{})}
+	go b.listenLoop(ctx, conn)
+	return b, nil
+}
+
+func listen(ctx context.Context, dsn string) (*pgx.Conn, error) {
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Exec(ctx, "LISTEN "+notifyChannel); err != nil {
+		conn.Close(ctx)
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (b *postgresBroker) Publish(payload []byte) error {
+	ctx := context.Background()
+
+	msg := string(payload)
+	if len(msg) > maxNotifyPayload {
+		var id int64
+		err := b.pool.QueryRow(ctx, "INSERT INTO broker_payloads (payload) VALUES ($1) RETURNING id", msg).Scan(&id)
+		if err != nil {
+			return err
+		}
+		b.pool.Exec(ctx, "DELETE FROM broker_payloads WHERE created_at < now() - make_interval(secs => $1)",
+			parkedPayloadTTL.Seconds())
+		msg = "@" + strconv.FormatInt(id, 10)
+	}
+
+	_, err := b.pool.Exec(ctx, "SELECT pg_notify($1, $2)", notifyChannel, msg)
+	return err
+}
+
+func (b *postgresBroker) Subscribe(fn func([]byte)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs = append(b.subs, fn)
+}
+
+// listenLoop hands every notification to the subscribers, reconnecting
+// whenever the connection drops.
+func (b *postgresBroker) listenLoop(ctx context.Context, conn *pgx.Conn) {
+	defer close(b.done)
+
+	for {
+		for conn != nil {
+			n, err := conn.WaitForNotification(ctx)
+			if err != nil {
+				conn.Close(context.Background())
+				conn = nil
+				break
+			}
+
+			payload, err := b.resolve(ctx, n.Payload)
+			if err != nil {
+				log.Println("Broker: reading parked payload:", err)
+				continue
+			}
+
+			b.mu.Lock()
+			subs := b.subs
+			b.mu.Unlock()
+			for _, fn := range subs {
+				fn(payload)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(listenRetry):
+		}
+
+		var err error
+		if conn, err = listen(ctx, b.dsn); err != nil {
+			log.Println("Broker: reconnecting listener:", err)
+		}
+	}
+}
+
+// resolve returns the payload a notification stands for.
+func (b *postgresBroker) resolve(ctx context.Context, msg string) ([]byte, error) {
+	id, parked := strings.CutPrefix(msg, "@")
+	if !parked {
+		return []byte(msg), nil
+	}
+
+	var payload string
+	err := b.pool.QueryRow(ctx, "SELECT payload FROM broker_payloads WHERE id = $1", id).Scan(&payload)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errors.New("payload " + id + " expired")
+	}
+	return []byte(payload), err
+}
+
+func (b *postgresBroker) Close() error {
+	b.cancel()
+	<-b.done
+	b.pool.Close()
+	return nil
+}
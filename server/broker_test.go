@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+)
+
+// startNode runs a hub on broker and waits until it is subscribed.
+func startNode(t *testing.T, broker Broker) *Hub {
+	t.Helper()
+	h := newHub(broker)
+	go h.run()
+	h.do(func(map[*Client]bool) {})
+	return h
+}
+
+// fakeClient is a registered-looking client without a connection; tests
+// read its frames straight from the send buffer.
+func fakeClient(id uint, username string, watching ...string) *Client {
+	c := newClient(nil)
+	c.UserID, c.Username = id, username
+	c.watching = make(map[string]bool)
+	for _, name := range watching {
+		c.watching[name] = true
+	}
+	return c
+}
+
+func nextFrame(t *testing.T, c *Client) map[string]interface{} {
+	t.Helper()
+	select {
+	case frame := <-c.send:
+		var v map[string]interface{}
+		if err := json.Unmarshal(frame, &v); err != nil {
+			t.Fatalf("decode frame %s: %v", frame, err)
+		}
+		return v
+	case <-time.After(2 * time.Second):
+		t.Fatalf("%s got no frame", c.Username)
+		return nil
+	}
+}
+
+func expectFrame(t *testing.T, c *Client, field, want string) {
+	t.Helper()
+	frame := nextFrame(t, c)
+	if got, _ := frame[field].(string); got != want {
+		t.Fatalf("%s got frame %v, want %s %q", c.Username, frame, field, want)
+	}
+}
+
+// waitPresence waits until h sees userID in state.
+func waitPresence(t *testing.T, h *Hub, userID uint, state string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var got string
+		h.do(func(map[*Client]bool) { got = h.presence(userID) })
+		if got == state {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("presence of user %d = %s, want %s", userID, got, state)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHubsShareBroker(t *testing.T) {
+	broker := newMemoryBroker()
+	nodeA, nodeB := startNode(t, broker), startNode(t, broker)
+
+	bob := fakeClient(2, "bob", "alice")
+	nodeB.register <- bob
+	expectFrame(t, bob, "content", "bob joined the chat")
+	waitPresence(t, nodeA, bob.UserID, presenceOnline)
+
+	// Alice connecting to the other node is announced to bob.
+	alice := fakeClient(1, "alice")
+	nodeA.register <- alice
+	expectFrame(t, alice, "content", "alice joined the chat")
+	expectFrame(t, bob, "content", "alice joined the chat")
+	expectFrame(t, bob, "status", presenceOnline)
+
+	var state string
+	var online []string
+	nodeB.do(func(map[*Client]bool) {
+		state = nodeB.presence(alice.UserID)
+		online = nodeB.onlineUsers()
+	})
+	slices.Sort(online)
+	if state != presenceOnline || !slices.Equal(online, []string{"alice", "bob"}) {
+		t.Errorf("node B sees alice %s and online %v, want online and [alice bob]", state, online)
+	}
+
+	// Messages reach users on either node.
+	nodeA.sendToUsers(systemEvent{Content: "hi bob"}, bob.UserID)
+	expectFrame(t, bob, "content", "hi bob")
+
+	saved := hub
+	hub = nodeA
+	t.Cleanup(func() { hub = saved })
+
+	broadcastSystem(0, "hello everyone")
+	expectFrame(t, alice, "content", "hello everyone")
+	expectFrame(t, bob, "content", "hello everyone")
+
+	// Exclusions hold on every node.
+	nodeA.sendExcept(typingEvent{User: "carol", State: "started"}, bob.UserID)
+	nodeA.sendToUsers(systemEvent{Content: "marker"}, bob.UserID)
+	expectFrame(t, bob, "content", "marker")
+
+	// Going away from the last node announces the user as gone.
+	nodeA.unregister <- alice
+	expectFrame(t, bob, "content", "alice left the chat")
+	expectFrame(t, bob, "status", presenceOffline)
+
+	// So does a node that shuts down or stops syncing.
+	alice = fakeClient(1, "alice")
+	nodeA.register <- alice
+	expectFrame(t, bob, "content", "alice joined the chat")
+	expectFrame(t, bob, "status", presenceOnline)
+
+	nodeB.do(func(map[*Client]bool) {
+		nodeB.expireNodes(time.Now().Add(2 * nodeTimeout))
+	})
+	expectFrame(t, bob, "content", "alice left the chat")
+	expectFrame(t, bob, "status", presenceOffline)
+
+	// The next sync brings the node back.
+	nodeA.publish(nodeA.syncEvent())
+	expectFrame(t, bob, "content", "alice joined the chat")
+	expectFrame(t, bob, "status", presenceOnline)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := nodeA.leaveCluster(ctx); err != nil {
+		t.Fatalf("leaveCluster() error = %v", err)
+	}
+	expectFrame(t, bob, "content", "alice left the chat")
+	expectFrame(t, bob, "status", presenceOffline)
+}
+
+func TestSendToReachesOneSession(t *testing.T) {
+	h := startNode(t, newMemoryBroker())
+	phone, laptop := fakeClient(1, "alice"), fakeClient(1, "alice")
+	bob := fakeClient(2, "bob")
+	for _, c := range []*Client{phone, laptop, bob} {
+		h.register <- c
+	}
+	waitPresence(t, h, 2, presenceOnline)
+	for _, c := range []*Client{phone, laptop, bob} {
+		for len(c.send) > 0 {
+			<-c.send
+		}
+	}
+
+	h.sendTo(laptop, systemEvent{Content: "just you"})
+	expectFrame(t, laptop, "content", "just you")
+
+	// Anything else queued by now would have come from the same dispatch.
+	h.do(func(map[*Client]bool) {})
+	for _, c := range []*Client{phone, bob} {
+		if len(c.send) > 0 {
+			t.Errorf("%s got %s", c.Username, <-c.send)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	modeDevelopment = "development"
+	modeProduction  = "production"
+
+	// defaultJWTSecret is only good for local development; the server
+	// refuses to start with it in production mode.
+	defaultJWTSecret = "super_secret_key_change_me"
+
+	redacted = "[redacted]"
+)
+
+// Config is the server configuration. It is built from defaults, then an
+// optional YAML or TOML file, then CHAT_* environment variables, each
+// overriding the one before.
+type Config struct {
+	Mode           string       `yaml:"mode" toml:"mode"`
+	Addr           string       `yaml:"addr" toml:"addr"`
+	JWTSecret      string       `yaml:"jwt_secret" toml:"jwt_secret"`
+	AllowedOrigins []string     `yaml:"allowed_origins" toml:"allowed_origins"`
+	UploadDir      string       `yaml:"upload_dir" toml:"upload_dir"`
+	Store          storeConfig  `yaml:"store" toml:"store"`
+	Broker         brokerConfig `yaml:"broker" toml:"broker"`
+}
+
+type storeConfig struct {
+	Driver string `yaml:"driver" toml:"driver"` // postgres, sqlite or memory
+	DSN    string `yaml:"dsn" toml:"dsn"`
+}
+
+// brokerConfig selects how hubs on different nodes talk to each other.
+type brokerConfig struct {
+	Driver string `yaml:"driver" toml:"driver"` // memory (single node) or postgres
+	DSN    string `yaml:"dsn" toml:"dsn"`       // defaults to the store's for postgres
+}
+
+var config Config
+
+func defaultConfig() Config {
+	return Config{
+		Mode:           modeDevelopment,
+		Addr:           ":8080",
+		JWTSecret:      defaultJWTSecret,
+		AllowedOrigins: []string{"http://localhost:8080", "http://127.0.0.1:5500"},
+		UploadDir:      "uploads",
+		Store:          storeConfig{Driver: "postgres"},
+		Broker:         brokerConfig{Driver: "memory"},
+	}
+}
+
+// loadConfig reads the configuration from path, if set, and the
+// environment, and validates the result.
+func loadConfig(path string) (Config, error) {
+	c := defaultConfig()
+
+	if path != "" {
+		if err := c.readFile(path); err != nil {
+			return c, fmt.Errorf("config file %s: %w", path, err)
+		}
+	}
+	c.readEnv()
+
+	if c.Store.DSN == "" {
+		switch c.Store.Driver {
+		case "postgres":
+			c.Store.DSN = "host=localhost user=postgres password=postgres dbname=chatapp port=5432 sslmode=disable"
+		case "sqlite":
+			c.Store.DSN = "chatapp.db"
+		}
+	}
+	if c.Broker.Driver == "postgres" && c.Broker.DSN == "" && c.Store.Driver == "postgres" {
+		c.Broker.DSN = c.Store.DSN
+	}
+
+	return c, c.validate()
+}
+
+// readFile decodes a YAML or TOML file, chosen by extension, over c.
+// Unknown keys are rejected so a typo doesn't silently fall back to a
+// default.
+func (c *Config) readFile(path string) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		dec := yaml.NewDecoder(f)
+		dec.KnownFields(true)
+		if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		return nil
+
+	case ".toml":
+		md, err := toml.DecodeFile(path, c)
+		if err != nil {
+			return err
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("unknown key %q", undecoded[0].String())
+		}
+		return nil
+
+	default:
+		return errors.New("unsupported format; use .yaml, .yml or .toml")
+	}
+}
+
+func (c *Config) readEnv() {
+	set := func(name string, dst *string) {
+		if v, ok := os.LookupEnv(name); ok {
+			*dst = v
+		}
+	}
+	set("CHAT_MODE", &c.Mode)
+	set("CHAT_ADDR", &c.Addr)
+	set("CHAT_JWT_SECRET", &c.JWTSecret)
+	set("CHAT_UPLOAD_DIR", &c.UploadDir)
+	set("CHAT_STORE", &c.Store.Driver)
+	set("CHAT_DSN", &c.Store.DSN)
+	set("CHAT_BROKER", &c.Broker.Driver)
+	set("CHAT_BROKER_DSN", &c.Broker.DSN)
+
+	// A comma-separated list.
+	if v, ok := os.LookupEnv("CHAT_ALLOWED_ORIGINS"); ok {
+		c.AllowedOrigins = nil
+		for _, origin := range strings.Split(v, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				c.AllowedOrigins = append(c.AllowedOrigins, origin)
+			}
+		}
+	}
+}
+
+func (c Config) validate() error {
+	var errs []error
+
+	if c.Mode != modeDevelopment && c.Mode != modeProduction {
+		errs = append(errs, fmt.Errorf("mode must be %q or %q, not %q", modeDevelopment, modeProduction, c.Mode))
+	}
+	if c.Addr == "" {
+		errs = append(errs, errors.New("addr is required"))
+	}
+	if c.JWTSecret == "" {
+		errs = append(errs, errors.New("jwt_secret is required"))
+	}
+	if c.Mode == modeProduction && c.JWTSecret == defaultJWTSecret {
+		errs = append(errs, errors.New("jwt_secret must be changed from the default in production"))
+	}
+	if c.UploadDir == "" {
+		errs = append(errs, errors.New("upload_dir is required"))
+	}
+	if !slices.Contains([]string{"postgres", "sqlite", "memory"}, c.Store.Driver) {
+		errs = append(errs, fmt.Errorf("store driver must be postgres, sqlite or memory, not %q", c.Store.Driver))
+	}
+	switch c.Broker.Driver {
+	case "memory":
+	case "postgres":
+		if c.Broker.DSN == "" {
+			errs = append(errs, errors.New("the postgres broker needs a dsn"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("broker driver must be memory or postgres, not %q", c.Broker.Driver))
+	}
+	for _, origin := range c.AllowedOrigins {
+		if !validOrigin(origin) {
+			errs = append(errs, fmt.Errorf("allowed origin %q must be scheme://host[:port]", origin))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validOrigin accepts what browsers send in the Origin header: a scheme and
+// host with no path.
+func validOrigin(origin string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && u.Scheme != "" && u.Host != "" && u.User == nil &&
+		(u.Path == "" || u.Path == "/") && u.RawQuery == "" && u.Fragment == ""
+}
+
+// originAllowed reports whether a browser page at origin may use the API.
+// Trailing slashes and letter case don't matter.
+func (c Config) originAllowed(origin string) bool {
+	origin = strings.TrimSuffix(origin, "/")
+	for _, allowed := range c.AllowedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// dsnPassword matches the password of a key=value connection string.
+var dsnPassword = regexp.MustCompile(`(?i)(password\s*=\s*)('[^']*'|\S+)`)
+
+// redactDSN hides the password in a key=value or URL connection string.
+func redactDSN(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.Scheme != "" && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+		}
+		return u.String()
+	}
+	return dsnPassword.ReplaceAllString(dsn, "${1}"+redacted)
+}
+
+// String describes the effective configuration with secrets redacted, for
+// the startup log.
+func (c Config) String() string {
+	return fmt.Sprintf("mode=%s addr=%s store=%s dsn=%q broker=%s broker_dsn=%q upload_dir=%s allowed_origins=%v jwt_secret=%s",
+		c.Mode, c.Addr, c.Store.Driver, redactDSN(c.Store.DSN), c.Broker.Driver, redactDSN(c.Broker.DSN),
+		c.UploadDir, c.AllowedOrigins, redacted)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// clearConfigEnv unsets every CHAT_* variable for the duration of a test.
+func clearConfigEnv(t *testing.T) {
+	for _, name := range []string{"CHAT_MODE", "CHAT_ADDR", "CHAT_JWT_SECRET", "CHAT_UPLOAD_DIR",
+		"CHAT_STORE", "CHAT_DSN", "CHAT_BROKER", "CHAT_BROKER_DSN", "CHAT_ALLOWED_ORIGINS"} {
+		if v, ok := os.LookupEnv(name); ok {
+			os.Unsetenv(name)
+			t.Cleanup(func() { os.Setenv(name, v) })
+		}
+	}
+}
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	clearConfigEnv(t)
+
+	c, err := loadConfig("")
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+	if c.Mode != modeDevelopment || c.Addr != ":8080" || c.Store.Driver != "postgres" {
+		t.Errorf("loadConfig() = %+v, want development defaults", c)
+	}
+	if !strings.Contains(c.Store.DSN, "dbname=chatapp") {
+		t.Errorf("DSN = %q, want the default Postgres DSN", c.Store.DSN)
+	}
+	if !c.originAllowed("http://127.0.0.1:5500") || c.originAllowed("http://evil.example") {
+		t.Errorf("AllowedOrigins = %v", c.AllowedOrigins)
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	files := map[string]string{
+		"chat.yaml": `
+mode: production
+addr: ":9000"
+jwt_secret: from-file
+allowed_origins:
+  - https://chat.example.com
+store:
+  driver: sqlite
+`,
+		"chat.toml": `
+mode = "production"
+addr = ":9000"
+jwt_secret = "from-file"
+allowed_origins = ["https://chat.example.com"]
+
+[store]
+driver = "sqlite"
+`,
+	}
+
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			clearConfigEnv(t)
+			t.Setenv("CHAT_ADDR", ":9100")
+
+			c, err := loadConfig(writeConfig(t, name, content))
+			if err != nil {
+				t.Fatalf("loadConfig() error = %v", err)
+			}
+			if c.Mode != modeProduction || c.JWTSecret != "from-file" || c.Store.Driver != "sqlite" {
+				t.Errorf("loadConfig() = %+v, want values from the file", c)
+			}
+			if c.Addr != ":9100" {
+				t.Errorf("Addr = %q, want the environment to override the file", c.Addr)
+			}
+			if c.Store.DSN != "chatapp.db" {
+				t.Errorf("DSN = %q, want the sqlite default", c.Store.DSN)
+			}
+			if !slices.Equal(c.AllowedOrigins, []string{"https://chat.example.com"}) {
+				t.Errorf("AllowedOrigins = %v", c.AllowedOrigins)
+			}
+		})
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		file string
+		want string
+	}{
+		{"default secret in production", map[string]string{"CHAT_MODE": "production"}, "", "changed from the default"},
+		{"unknown mode", map[string]string{"CHAT_MODE": "staging"}, "", "mode must be"},
+		{"unknown driver", map[string]string{"CHAT_STORE": "mysql"}, "", "store driver"},
+		{"unknown broker", map[string]string{"CHAT_BROKER": "redis"}, "", "broker driver"},
+		{"postgres broker without dsn", map[string]string{"CHAT_STORE": "memory", "CHAT_BROKER": "postgres"}, "", "needs a dsn"},
+		{"origin with path", map[string]string{"CHAT_ALLOWED_ORIGINS": "https://a.example/app"}, "", "allowed origin"},
+		{"unknown key", nil, "jwt_secert: typo\n", "jwt_secert"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearConfigEnv(t)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			path := ""
+			if tt.file != "" {
+				path = writeConfig(t, "chat.yaml", tt.file)
+			}
+
+			_, err := loadConfig(path)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("loadConfig() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigStringRedactsSecrets(t *testing.T) {
+	tests := []string{
+		"host=db user=chat password=hunter2 dbname=chat",
+		"host=db user=chat password='hunter2' dbname=chat",
+		"postgres://chat:hunter2@db:5432/chat",
+	}
+
+	for _, dsn := range tests {
+		c := defaultConfig()
+		c.JWTSecret = "hunter2"
+		c.Store.DSN = dsn
+
+		s := c.String()
+		if strings.Contains(s, "hunter2") {
+			t.Errorf("String() = %q, leaks a secret", s)
+		}
+		if !strings.Contains(s, "chat") {
+			t.Errorf("String() = %q, want the rest of the DSN kept", s)
+		}
+	}
+}
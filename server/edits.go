@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// MessageEdit keeps the content a message had before each edit.
+type MessageEdit struct {
+	ID        uint `gorm:"primaryKey"`
+	MessageID uint `gorm:"index;not null"`
+	Content   string
+	EditedAt  time.Time
+}
+
+var (
+	errMessageNotFound = errors.New("message not found")
+	errNotMessageOwner = errors.New("not your message")
+	errMessageDeleted  = errors.New("message was deleted")
+	errEmptyContent    = errors.New("content required")
+	errContentTooLong  = errors.New("content too long")
+)
+
+// ownMessage loads a live message sent by userID.
+func ownMessage(userID, messageID uint) (Message, error) {
+	m, err := store.Message(messageID)
+	if errors.Is(err, errNotFound) {
+		return m, errMessageNotFound
+	}
+	if err != nil {
+		return m, err
+	}
+	if m.SenderID != userID {
+		return m, errNotMessageOwner
+	}
+	if m.DeletedAt != nil {
+		return m, errMessageDeleted
+	}
+	return m, nil
+}
+
+// editMessage replaces the content of one of the user's messages, keeping
+// the previous version in the edit history.
+func editMessage(userID, messageID uint, content string) (Message, error) {
+	if strings.TrimSpace(content) == "" {
+		return Message{}, errEmptyContent
+	}
+	if utf8.RuneCountInString(content) > maxContentLength {
+		return Message{}, errContentTooLong
+	}
+
+	m, err := ownMessage(userID, messageID)
+	if err != nil {
+		return m, err
+	}
+	// An edit reaches the whole room, so it is held to the same rules as a
+	// new message.
+	if m.RoomID != nil {
+		if err := canPostToRoom(*m.RoomID, userID); err != nil {
+			return m, err
+		}
+	}
+
+	now := time.Now()
+	if err := store.EditMessage(m.ID, content, now); err != nil {
+		return m, changeError(err)
+	}
+	m.Content = content
+	m.EditedAt = &now
+
+	broadcastToAudience(m, messageUpdatedEvent{
+		ID:       m.ID,
+		Content:  m.Content,
+		EditedAt: m.EditedAt,
+		Room:     derefID(m.RoomID),
+	})
+	if m.ParentID != nil {
+		pushThreadUpdate(*m.ParentID)
+	}
+	recordMentions(m)
+	return m, nil
+}
+
+// deleteMessage turns one of the user's messages, or one a room moderator
+// may remove, into a tombstone. The row stays so history keeps its place,
+// but the content is dropped.
+func deleteMessage(userID, messageID uint) (Message, error) {
+	m, err := ownMessage(userID, messageID)
+	var mod *moderator
+	if errors.Is(err, errNotMessageOwner) {
+		mod, err = messageModerator(userID, m)
+	}
+	if err != nil {
+		return m, err
+	}
+
+	now := time.Now()
+	blobKeys, err := store.DeleteMessage(m.ID, now)
+	if err != nil {
+		return m, changeError(err)
+	}
+	m.Content = ""
+	m.DeletedAt = &now
+
+	deleteBlobs(blobKeys)
+	if m.RoomID != nil {
+		store.UnpinMessage(*m.RoomID, m.ID)
+	}
+	if mod != nil {
+		mod.record(ModerationEntry{Action: actionDelete, TargetID: &m.SenderID, MessageID: &m.ID})
+	}
+
+	broadcastToAudience(m, messageDeletedEvent{ID: m.ID, DeletedAt: m.DeletedAt, Room: derefID(m.RoomID)})
+	if m.ParentID != nil {
+		pushThreadUpdate(*m.ParentID)
+	}
+	return m, nil
+}
+
+// changeError translates the error of a store update made after ownMessage
+// succeeded: a message that vanished in between was deleted concurrently.
+func changeError(err error) error {
+	if errors.Is(err, errNotFound) {
+		return errMessageDeleted
+	}
+	return err
+}
+
+// broadcastToAudience sends an event about m to everyone who can see it:
+// the room's current members, the sender plus its recorded recipients for
+// direct messages, or everyone for lobby messages.
+func broadcastToAudience(m Message, frame serverEvent) {
+	if m.RoomID == nil && m.ReceiverID == nil {
+		hub.send(frame, nil)
+		return
+	}
+	if m.RoomID != nil {
+		broadcastToRoom(*m.RoomID, frame)
+		return
+	}
+
+	ids, _ := store.ReceiptUserIDs(m.ID)
+	hub.sendToUsers(frame, append(ids, m.SenderID)...)
+}
+
+// canViewMessage reports whether userID took part in m's conversation.
+func canViewMessage(userID uint, m Message) bool {
+	switch {
+	case m.RoomID != nil:
+		return isRoomMember(*m.RoomID, userID)
+	case m.ReceiverID != nil:
+		return m.SenderID == userID || *m.ReceiverID == userID
+	default:
+		return true
+	}
+}
+
+// sendEditError reports a failed edit or delete on the socket.
+func sendEditError(c *Client, err error) {
+	switch {
+	case errors.Is(err, errMessageNotFound):
+		sendError(c, "unknown_message", "Message does not exist")
+	case errors.Is(err, errNotMessageOwner):
+		sendError(c, "forbidden", "You can only change your own messages")
+	case errors.Is(err, errMessageDeleted):
+		sendError(c, "message_deleted", "Message was deleted")
+	case errors.Is(err, errEmptyContent):
+		sendError(c, "invalid_content", "Content required")
+	case errors.Is(err, errContentTooLong):
+		sendError(c, "content_too_long", fmt.Sprintf("Messages are limited to %d characters", maxContentLength))
+	case errors.Is(err, errNotInRoom):
+		sendError(c, "not_member", "You are no longer a member of this room")
+	case errors.Is(err, errMutedInRoom):
+		sendError(c, "room_muted", "You are muted in this room")
+	default:
+		sendError(c, "internal", "Could not update message")
+	}
+}
+
+// ================= EDIT HANDLERS =================
+
+func httpEditError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errMessageNotFound):
+		http.Error(w, "Message not found", http.StatusNotFound)
+	case errors.Is(err, errNotMessageOwner):
+		http.Error(w, "You can only change your own messages", http.StatusForbidden)
+	case errors.Is(err, errMessageDeleted):
+		http.Error(w, "Message was deleted", http.StatusGone)
+	case errors.Is(err, errEmptyContent):
+		http.Error(w, "Content required", http.StatusBadRequest)
+	case errors.Is(err, errContentTooLong):
+		http.Error(w, fmt.Sprintf("Messages are limited to %d characters", maxContentLength), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, errNotInRoom):
+		http.Error(w, "You are no longer a member of this room", http.StatusForbidden)
+	case errors.Is(err, errMutedInRoom):
+		http.Error(w, "You are muted in this room", http.StatusForbidden)
+	default:
+		http.Error(w, "Could not update message", http.StatusInternalServerError)
+	}
+}
+
+func messageIDFromPath(w http.ResponseWriter, r *http.Request) (uint, bool) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid message id", http.StatusBadRequest)
+		return 0, false
+	}
+	return uint(id), true
+}
+
+func editMessageHandler(w http.ResponseWriter, r *http.Request, user User) {
+	id, ok := messageIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Content string `json:"content"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	m, err := editMessage(user.ID, id, req.Content)
+	if err != nil {
+		httpEditError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(toMessageViews(user.ID, []Message{m})[0])
+}
+
+func deleteMessageHandler(w http.ResponseWriter, r *http.Request, user User) {
+	id, ok := messageIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if _, err := deleteMessage(user.ID, id); err != nil {
+		httpEditError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// messageEditsHandler lists the previous versions of a message, oldest
+// first, to anyone who can see the message.
+func messageEditsHandler(w http.ResponseWriter, r *http.Request, user User) {
+	id, ok := messageIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	m, err := store.Message(id)
+	if err != nil || !canViewMessage(user.ID, m) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	var edits []MessageEdit
+	if m.DeletedAt == nil {
+		edits, _ = store.MessageEdits(m.ID)
+	}
+
+	type editView struct {
+		Content  string    `json:"content"`
+		EditedAt time.Time `json:"edited_at"`
+	}
+	list := make([]editView, 0, len(edits))
+	for _, e := range edits {
+		list = append(list, editView{Content: e.Content, EditedAt: e.EditedAt})
+	}
+
+	json.NewEncoder(w).Encode(list)
+}
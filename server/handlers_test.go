@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "chat-uploads")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	config = defaultConfig()
+	blobs = newLocalBlobStore(dir)
+	go hub.run()
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// resetStore gives each test an empty in-memory store, once connections
+// left over from earlier tests have finished with the old one.
+func resetStore(t *testing.T) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := conns.wait(ctx); err != nil {
+		t.Fatalf("waiting for earlier connections: %v", err)
+	}
+	store = newMemoryStore()
+}
+
+// do sends a request through the full router. token may be empty; body is
+// encoded as JSON unless nil.
+func do(t *testing.T, method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatalf("encode body: %v", err)
+		}
+	}
+
+	req := httptest.NewRequest(method, path, &buf)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	routes().ServeHTTP(rec, req)
+	return rec
+}
+
+func decode(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.NewDecoder(rec.Body).Decode(v); err != nil {
+		t.Fatalf("decode response %q: %v", rec.Body.String(), err)
+	}
+}
+
+type tokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// register creates a user and returns it with its tokens.
+func register(t *testing.T, username string) (User, tokenResponse) {
+	t.Helper()
+
+	rec := do(t, "POST", "/register", "", credentials{Username: username, Password: "password123"})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("register %s: status %d: %s", username, rec.Code, rec.Body.String())
+	}
+
+	var tokens tokenResponse
+	decode(t, rec, &tokens)
+
+	user, err := store.UserByName(username)
+	if err != nil {
+		t.Fatalf("UserByName(%q) error = %v", username, err)
+	}
+	return user, tokens
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	resetStore(t)
+	_, tokens := register(t, "alice")
+	if tokens.Token == "" || tokens.RefreshToken == "" || tokens.ExpiresIn <= 0 {
+		t.Fatalf("register returned %+v", tokens)
+	}
+	// Accounts created before passwords existed have an empty hash.
+	if err := store.CreateUser(&User{Username: "legacy"}); err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		body   credentials
+		status int
+	}{
+		{"duplicate username", "/register", credentials{"alice", "password123"}, http.StatusConflict},
+		{"invalid username", "/register", credentials{"a!", "password123"}, http.StatusBadRequest},
+		{"short password", "/register", credentials{"bob", "short"}, http.StatusBadRequest},
+		{"login", "/login", credentials{"alice", "password123"}, http.StatusOK},
+		{"wrong password", "/login", credentials{"alice", "password124"}, http.StatusUnauthorized},
+		{"unknown user", "/login", credentials{"nobody", "password123"}, http.StatusUnauthorized},
+		{"user without a password", "/login", credentials{"legacy", "not-a-real-password"}, http.StatusUnauthorized},
+		{"user without a password taken", "/register", credentials{"legacy", "password123"}, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := do(t, "POST", tt.path, "", tt.body)
+			if rec.Code != tt.status {
+				t.Errorf("POST %s status = %d, want %d: %s", tt.path, rec.Code, tt.status, rec.Body.String())
+			}
+		})
+	}
+
+	// Only an administrator can unlock an account without a password.
+	if err := setPassword("legacy", strings.NewReader("short\n")); err == nil {
+		t.Error("setPassword() accepted a short password")
+	}
+	if err := setPassword("legacy", strings.NewReader("password123\n")); err != nil {
+		t.Fatalf("setPassword() error = %v", err)
+	}
+	if rec := do(t, "POST", "/login", "", credentials{"legacy", "password123"}); rec.Code != http.StatusOK {
+		t.Errorf("login after setPassword() status = %d, want 200", rec.Code)
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	resetStore(t)
+	_, tokens := register(t, "alice")
+
+	if rec := do(t, "GET", "/rooms", "", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET /rooms without token status = %d, want 401", rec.Code)
+	}
+	if rec := do(t, "GET", "/rooms", "not-a-token", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET /rooms with bad token status = %d, want 401", rec.Code)
+	}
+	if rec := do(t, "GET", "/rooms", tokens.Token, nil); rec.Code != http.StatusOK {
+		t.Errorf("GET /rooms status = %d, want 200", rec.Code)
+	}
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	resetStore(t)
+	_, tokens := register(t, "alice")
+
+	rec := do(t, "POST", "/token/refresh", "", refreshRequest{tokens.RefreshToken})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("refresh status = %d: %s", rec.Code, rec.Body.String())
+	}
+	var rotated tokenResponse
+	decode(t, rec, &rotated)
+	if rotated.RefreshToken == tokens.RefreshToken {
+		t.Fatal("refresh token was not rotated")
+	}
+
+	// Presenting the used token again revokes the whole family.
+	rec = do(t, "POST", "/token/refresh", "", refreshRequest{tokens.RefreshToken})
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("reused refresh status = %d, want 401", rec.Code)
+	}
+	if rec := do(t, "POST", "/token/refresh", "", refreshRequest{rotated.RefreshToken}); rec.Code != http.StatusUnauthorized {
+		t.Errorf("refresh after reuse status = %d, want 401", rec.Code)
+	}
+	if rec := do(t, "GET", "/rooms", rotated.Token, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("access token of revoked family status = %d, want 401", rec.Code)
+	}
+}
+
+func TestRooms(t *testing.T) {
+	resetStore(t)
+	_, alice := register(t, "alice")
+	_, bob := register(t, "bob")
+
+	rec := do(t, "POST", "/rooms", alice.Token, map[string]string{"name": "general"})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create room status = %d: %s", rec.Code, rec.Body.String())
+	}
+	var room Room
+	decode(t, rec, &room)
+
+	listRooms := func(token string) []roomView {
+		rec := do(t, "GET", "/rooms", token, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("list rooms status = %d", rec.Code)
+		}
+		var list []roomView
+		decode(t, rec, &list)
+		return list
+	}
+
+	if list := listRooms(bob.Token); len(list) != 1 || list[0].Members != 1 || list[0].Joined {
+		t.Fatalf("rooms before join = %+v, want one room with one member, not joined", list)
+	}
+
+	join := fmt.Sprintf("/rooms/%d/join", room.ID)
+	leave := fmt.Sprintf("/rooms/%d/leave", room.ID)
+	if rec := do(t, "POST", join, bob.Token, nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("join status = %d", rec.Code)
+	}
+	if list := listRooms(bob.Token); list[0].Members != 2 || !list[0].Joined {
+		t.Errorf("rooms after join = %+v, want two members, joined", list)
+	}
+
+	if rec := do(t, "POST", leave, bob.Token, nil); rec.Code != http.StatusNoContent {
+		t.Errorf("leave status = %d", rec.Code)
+	}
+	if rec := do(t, "POST", leave, bob.Token, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("second leave status = %d, want 404", rec.Code)
+	}
+	if rec := do(t, "POST", "/rooms/999/join", bob.Token, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("join unknown room status = %d, want 404", rec.Code)
+	}
+	if rec := do(t, "POST", "/rooms", alice.Token, map[string]string{"name": "  "}); rec.Code != http.StatusBadRequest {
+		t.Errorf("create blank room status = %d, want 400", rec.Code)
+	}
+
+	// Only members can read the room's history.
+	path := fmt.Sprintf("/messages?room=%d", room.ID)
+	if rec := do(t, "GET", path, bob.Token, nil); rec.Code != http.StatusForbidden {
+		t.Errorf("history of room left status = %d, want 403", rec.Code)
+	}
+	if rec := do(t, "GET", path, alice.Token, nil); rec.Code != http.StatusOK {
+		t.Errorf("history of own room status = %d, want 200", rec.Code)
+	}
+}
+
+func TestRoomSlowModeSetting(t *testing.T) {
+	resetStore(t)
+	_, alice := register(t, "alice")
+	_, bob := register(t, "bob")
+
+	rec := do(t, "POST", "/rooms", alice.Token, map[string]string{"name": "general"})
+	var room Room
+	decode(t, rec, &room)
+	path := fmt.Sprintf("/rooms/%d", room.ID)
+
+	if rec := do(t, "PATCH", path, bob.Token, map[string]int{"slow_mode": 30}); rec.Code != http.StatusForbidden {
+		t.Errorf("non-creator status = %d, want 403", rec.Code)
+	}
+	if rec := do(t, "PATCH", path, alice.Token, map[string]int{"slow_mode": -1}); rec.Code != http.StatusBadRequest {
+		t.Errorf("negative slow mode status = %d, want 400", rec.Code)
+	}
+
+	rec = do(t, "PATCH", path, alice.Token, map[string]int{"slow_mode": 30})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("set slow mode status = %d: %s", rec.Code, rec.Body.String())
+	}
+	if got, _ := store.Room(room.ID); got.SlowMode != 30 {
+		t.Errorf("SlowMode = %d, want 30", got.SlowMode)
+	}
+}
+
+// sendDirectMessages stores n direct messages from sender to receiver a
+// second apart and returns them oldest first.
+func sendDirectMessages(t *testing.T, sender, receiver User, n int) []Message {
+	t.Helper()
+
+	start := time.Now().Add(-time.Hour)
+	msgs := make([]Message, 0, n)
+	for i := 0; i < n; i++ {
+		m := Message{
+			SenderID:   sender.ID,
+			ReceiverID: &receiver.ID,
+			Content:    fmt.Sprintf("message %d", i),
+			Timestamp:  start.Add(time.Duration(i) * time.Second),
+		}
+		if err := store.CreateMessage(&m, []uint{receiver.ID}); err != nil {
+			t.Fatalf("CreateMessage() error = %v", err)
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs
+}
+
+type historyPage struct {
+	Messages   []messageView `json:"messages"`
+	NextCursor string        `json:"next_cursor"`
+}
+
+func TestMessagesPagination(t *testing.T) {
+	resetStore(t)
+	alice, aliceTokens := register(t, "alice")
+	bob, _ := register(t, "bob")
+	_, carolTokens := register(t, "carol")
+	sent := sendDirectMessages(t, alice, bob, 5)
+
+	var got []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("pagination did not terminate")
+		}
+		rec := do(t, "GET", "/messages?with=bob&limit=2&before="+cursor, aliceTokens.Token, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET /messages status = %d: %s", rec.Code, rec.Body.String())
+		}
+		var page historyPage
+		decode(t, rec, &page)
+
+		// Pages are walked backwards; each one is oldest first.
+		var contents []string
+		for _, m := range page.Messages {
+			contents = append(contents, m.Content)
+		}
+		got = append(contents, got...)
+
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+
+	var want []string
+	for _, m := range sent {
+		want = append(want, m.Content)
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("paged history = %v, want %v", got, want)
+	}
+
+	// Someone else's direct messages are not part of carol's chat with bob.
+	rec := do(t, "GET", "/messages?with=bob", carolTokens.Token, nil)
+	var page historyPage
+	decode(t, rec, &page)
+	if len(page.Messages) != 0 {
+		t.Errorf("carol sees %d messages of alice and bob", len(page.Messages))
+	}
+
+	if rec := do(t, "GET", "/messages?with=bob&before=garbage", aliceTokens.Token, nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("bad cursor status = %d, want 400", rec.Code)
+	}
+	if rec := do(t, "GET", "/messages?with=nobody", aliceTokens.Token, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown peer status = %d, want 404", rec.Code)
+	}
+}
+
+func TestOfflineFlushStopsWithWriter(t *testing.T) {
+	resetStore(t)
+	alice, _ := register(t, "alice")
+	bob, _ := register(t, "bob")
+	sendDirectMessages(t, alice, bob, 3)
+
+	// The connection died with bob's send buffer full.
+	client := fakeClient(bob.ID, "bob")
+	for len(client.send) < cap(client.send) {
+		client.send <- nil
+	}
+	close(client.stopped)
+
+	flushed := make(chan uint)
+	go func() { flushed <- flushOffline(client, 0) }()
+	select {
+	case id := <-flushed:
+		if id != 0 {
+			t.Errorf("flushOffline() = %d, want 0 as nothing was sent", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("flushOffline() blocked after the writer exited")
+	}
+}
+
+func TestEditAndDeleteMessage(t *testing.T) {
+	resetStore(t)
+	alice, aliceTokens := register(t, "alice")
+	bob, bobTokens := register(t, "bob")
+	m := sendDirectMessages(t, alice, bob, 1)[0]
+	path := fmt.Sprintf("/messages/%d", m.ID)
+
+	if rec := do(t, "PATCH", path, bobTokens.Token, map[string]string{"content": "hijacked"}); rec.Code != http.StatusForbidden {
+		t.Errorf("edit by other user status = %d, want 403", rec.Code)
+	}
+	if rec := do(t, "PATCH", path, aliceTokens.Token, map[string]string{"content": " "}); rec.Code != http.StatusBadRequest {
+		t.Errorf("blank edit status = %d, want 400", rec.Code)
+	}
+
+	rec := do(t, "PATCH", path, aliceTokens.Token, map[string]string{"content": "fixed"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("edit status = %d: %s", rec.Code, rec.Body.String())
+	}
+	var view messageView
+	decode(t, rec, &view)
+	if view.Content != "fixed" || view.EditedAt == nil {
+		t.Errorf("edited message = %+v", view)
+	}
+
+	rec = do(t, "GET", path+"/edits", bobTokens.Token, nil)
+	var edits []struct {
+		Content string `json:"content"`
+	}
+	decode(t, rec, &edits)
+	if len(edits) != 1 || edits[0].Content != m.Content {
+		t.Errorf("edit history = %+v, want the original content", edits)
+	}
+
+	if rec := do(t, "DELETE", path, aliceTokens.Token, nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete status = %d", rec.Code)
+	}
+	if rec := do(t, "PATCH", path, aliceTokens.Token, map[string]string{"content": "again"}); rec.Code != http.StatusGone {
+		t.Errorf("edit after delete status = %d, want 410", rec.Code)
+	}
+
+	stored, _ := store.Message(m.ID)
+	if stored.Content != "" || stored.DeletedAt == nil {
+		t.Errorf("deleted message = %+v, want an empty tombstone", stored)
+	}
+}
+
+func TestMentionedUsers(t *testing.T) {
+	resetStore(t)
+	bob, _ := register(t, "bob")
+	dotted, _ := register(t, "j.r.")
+
+	tests := []struct {
+		content string
+		want    []string
+	}{
+		{"thanks @bob.", []string{"bob"}},
+		{"ask @j.r. and @bob", []string{dotted.Username, bob.Username}},
+		{"@j.r.. again", []string{dotted.Username}},
+		{"@carol.", nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, u := range mentionedUsers(tt.content) {
+			got = append(got, u.Username)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("mentionedUsers(%q) = %v, want %v", tt.content, got, tt.want)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	resetStore(t)
+	alice, aliceTokens := register(t, "alice")
+	bob, _ := register(t, "bob")
+	_, carolTokens := register(t, "carol")
+
+	for _, content := range []string{"lunch at noon?", "the <b>Lunch</b> \x01menu\x02", "unrelated"} {
+		m := Message{SenderID: alice.ID, ReceiverID: &bob.ID, Content: content, Timestamp: time.Now()}
+		if err := store.CreateMessage(&m, []uint{bob.ID}); err != nil {
+			t.Fatalf("CreateMessage() error = %v", err)
+		}
+	}
+
+	rec := do(t, "GET", "/search?q=lunch", aliceTokens.Token, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("search status = %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		Results []searchResult `json:"results"`
+	}
+	decode(t, rec, &resp)
+	if len(resp.Results) != 2 {
+		t.Fatalf("search returned %d results, want 2", len(resp.Results))
+	}
+	// Newest first, content escaped and only matches marked.
+	if got, want := resp.Results[0].Snippet, "the &lt;b&gt;<mark>Lunch</mark>&lt;/b&gt; menu"; got != want {
+		t.Errorf("snippet = %q, want %q", got, want)
+	}
+
+	rec = do(t, "GET", "/search?q=lunch", carolTokens.Token, nil)
+	decode(t, rec, &resp)
+	if len(resp.Results) != 0 {
+		t.Errorf("carol found %d messages of alice and bob", len(resp.Results))
+	}
+
+	if rec := do(t, "GET", "/search?q=", aliceTokens.Token, nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("empty query status = %d, want 400", rec.Code)
+	}
+
+	filters := []struct {
+		query string
+		want  int
+	}{
+		{"sender=alice", 2},
+		{"sender=bob", 0},
+		{"from=" + url.QueryEscape(time.Now().Add(-time.Hour).Format(time.RFC3339)), 2},
+		{"from=" + url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339)), 0},
+	}
+	for _, f := range filters {
+		rec := do(t, "GET", "/search?q=lunch&"+f.query, aliceTokens.Token, nil)
+		decode(t, rec, &resp)
+		if len(resp.Results) != f.want {
+			t.Errorf("search with %s returned %d results, want %d", f.query, len(resp.Results), f.want)
+		}
+	}
+	if rec := do(t, "GET", "/search?q=lunch&sender=nobody", aliceTokens.Token, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown sender status = %d, want 404", rec.Code)
+	}
+	if rec := do(t, "GET", "/search?q=lunch&from=yesterday", aliceTokens.Token, nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid from status = %d, want 400", rec.Code)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	historyReplayLimit  = 50
+	historyDefaultLimit = 50
+	historyMaxLimit     = 100
+)
+
+// conversation identifies a message stream from one user's point of view:
+// a room, a direct chat with a peer, the replies to a thread, or the lobby
+// when all are zero.
+type conversation struct {
+	RoomID   uint
+	PeerID   uint
+	ThreadID uint
+}
+
+type messageView struct {
+	ID        uint              `json:"id"`
+	Sender    string            `json:"sender"`
+	Recipient string            `json:"recipient,omitempty"`
+	Room      uint              `json:"room,omitempty"`
+	Content   string            `json:"content"`
+	Timestamp time.Time         `json:"timestamp"`
+	EditedAt  *time.Time        `json:"edited_at,omitempty"`
+	Deleted   bool              `json:"deleted,omitempty"`
+	Reactions []reactionSummary `json:"reactions,omitempty"`
+	ParentID  uint              `json:"parent_id,omitempty"`
+	Thread    *threadSummary    `json:"thread,omitempty"`
+
+	Attachments []attachmentView `json:"attachments,omitempty"`
+	Status      string           `json:"status,omitempty"` // receipt state of the viewer's own messages
+}
+
+// loadMessages returns up to limit messages of a conversation older than the
+// cursor (or the newest ones when cursor is empty), oldest first. hasMore
+// reports whether older messages remain.
+func loadMessages(userID uint, c conversation, cursor string, limit int) (msgs []Message, hasMore bool, err error) {
+	var before *pagePos
+	if cursor != "" {
+		ts, id, err := decodeCursor(cursor)
+		if err != nil {
+			return nil, false, err
+		}
+		before = &pagePos{Timestamp: ts, ID: id}
+	}
+
+	msgs, err = store.ConversationMessages(userID, c, before, limit+1)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(msgs) > limit {
+		msgs = msgs[:limit]
+		hasMore = true
+	}
+
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+	return msgs, hasMore, nil
+}
+
+// usernamesByID maps user IDs to names.
+func usernamesByID(ids []uint) map[uint]string {
+	users, _ := store.UsersByID(ids)
+	names := make(map[uint]string, len(users))
+	for _, u := range users {
+		names[u.ID] = u.Username
+	}
+	return names
+}
+
+// toMessageViews resolves sender and recipient names for a batch of messages
+// and the receipt state of those sent by viewerID.
+func toMessageViews(viewerID uint, msgs []Message) []messageView {
+	ids := make([]uint, 0, len(msgs))
+	var own, all []uint
+	for _, m := range msgs {
+		all = append(all, m.ID)
+		ids = append(ids, m.SenderID)
+		if m.ReceiverID != nil {
+			ids = append(ids, *m.ReceiverID)
+		}
+		if m.SenderID == viewerID {
+			own = append(own, m.ID)
+		}
+	}
+	status := receiptStatus(own)
+	reactions := summarizeReactions(all)
+	threads := summarizeThreads(all)
+	attachments := messageAttachments(all)
+
+	names := usernamesByID(ids)
+
+	views := make([]messageView, 0, len(msgs))
+	for _, m := range msgs {
+		v := messageView{
+			ID:        m.ID,
+			Sender:    names[m.SenderID],
+			Content:   m.Content,
+			Timestamp: m.Timestamp,
+			EditedAt:  m.EditedAt,
+			Deleted:   m.DeletedAt != nil,
+			Reactions: reactions[m.ID],
+			Thread:    threads[m.ID],
+			Status:    status[m.ID],
+		}
+		if m.ReceiverID != nil {
+			v.Recipient = names[*m.ReceiverID]
+		}
+		if m.RoomID != nil {
+			v.Room = *m.RoomID
+		}
+		if m.ParentID != nil {
+			v.ParentID = *m.ParentID
+		}
+		if list := attachments[m.ID]; len(list) > 0 {
+			v.Attachments = attachmentViews(list)
+		}
+		views = append(views, v)
+	}
+	return views
+}
+
+// encodeCursor builds an opaque pagination cursor pointing at m.
+func encodeCursor(m Message) string {
+	raw := fmt.Sprintf("%d:%d", m.Timestamp.UnixNano(), m.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(cursor string) (time.Time, uint, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, 0, errors.New("invalid cursor")
+	}
+
+	tsPart, idPart, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return time.Time{}, 0, errors.New("invalid cursor")
+	}
+
+	nanos, err := strconv.ParseInt(tsPart, 10, 64)
+	if err != nil {
+		return time.Time{}, 0, errors.New("invalid cursor")
+	}
+	id, err := strconv.ParseUint(idPart, 10, 64)
+	if err != nil {
+		return time.Time{}, 0, errors.New("invalid cursor")
+	}
+
+	return time.Unix(0, nanos), uint(id), nil
+}
+
+// userConversations lists every conversation userID takes part in: the
+// lobby, each joined room and each direct chat partner.
+func userConversations(userID uint) []conversation {
+	convs := []conversation{{}}
+
+	roomIDs, _ := store.UserRoomIDs(userID)
+	for _, id := range roomIDs {
+		convs = append(convs, conversation{RoomID: id})
+	}
+
+	peerIDs, _ := store.DirectPeerIDs(userID)
+	for _, id := range peerIDs {
+		convs = append(convs, conversation{PeerID: id})
+	}
+
+	return convs
+}
+
+// replayHistory queues the most recent messages of each of the client's
+// conversations so a reconnecting client starts with a populated window.
+// It must run before the client is registered with the hub.
+func replayHistory(client *Client) {
+	for _, c := range userConversations(client.UserID) {
+		msgs, hasMore, err := loadMessages(client.UserID, c, "", historyReplayLimit)
+		if err != nil || len(msgs) == 0 {
+			continue
+		}
+
+		frame := historyEvent{
+			Messages: toMessageViews(client.UserID, msgs),
+			Room:     c.RoomID,
+		}
+		if c.PeerID != 0 {
+			peer, _ := store.UserByID(c.PeerID)
+			frame.With = peer.Username
+		}
+		if hasMore {
+			frame.NextCursor = encodeCursor(msgs[0])
+		}
+
+		if !client.queue(frame) {
+			return
+		}
+	}
+}
+
+// ================= HISTORY HANDLER =================
+
+// messagesHandler serves GET /messages?room=&with=&before=&limit=. With
+// neither room nor with set it pages through the lobby.
+func messagesHandler(w http.ResponseWriter, r *http.Request, user User) {
+	query := r.URL.Query()
+
+	limit := historyDefaultLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, historyMaxLimit)
+	}
+
+	var conv conversation
+	if v := query.Get("room"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid room id", http.StatusBadRequest)
+			return
+		}
+		if !isRoomMember(uint(id), user.ID) {
+			http.Error(w, "Not a member of this room", http.StatusForbidden)
+			return
+		}
+		conv.RoomID = uint(id)
+	} else if v := query.Get("with"); v != "" {
+		peer, err := store.UserByName(v)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		conv.PeerID = peer.ID
+	}
+
+	before := query.Get("before")
+	if before != "" {
+		if _, _, err := decodeCursor(before); err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	msgs, hasMore, err := loadMessages(user.ID, conv, before, limit)
+	if err != nil {
+		http.Error(w, "Could not load messages", http.StatusInternalServerError)
+		return
+	}
+
+	resp := struct {
+		Messages   []messageView `json:"messages"`
+		NextCursor string        `json:"next_cursor,omitempty"`
+	}{
+		Messages: toMessageViews(user.ID, msgs),
+	}
+	if hasMore {
+		resp.NextCursor = encodeCursor(msgs[0])
+	}
+
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Time allowed to write a frame to the peer.
+	writeWait = 10 * time.Second
+
+	// Time allowed to read the next pong from the peer.
+	pongWait = 60 * time.Second
+
+	// Pings are sent with this period; it must be less than pongWait.
+	pingPeriod = pongWait * 9 / 10
+
+	// Frames buffered per client before it is considered too slow and
+	// evicted.
+	sendBufferSize = 256
+)
+
+// Client is one websocket connection. Its fields other than send are only
+// read by the hub goroutine once the client is registered.
+type Client struct {
+	Conn     *websocket.Conn
+	Username string
+	UserID   uint
+	Family   string // refresh family of the token the session was opened with
+	Device   string // client-chosen device ID, empty if not supplied
+
+	protocol string       // negotiated subprotocol, empty for flat frames
+	frameID  string       // envelope ID of the inbound frame being handled
+	stream   *eventStream // set instead of Conn for Server-Sent Events clients
+
+	send     chan []byte
+	stopped  chan struct{} // closed when the client's writer exits
+	expiry   *time.Timer
+	away     bool            // set by the client when idle
+	watching map[string]bool // usernames whose presence this client follows
+}
+
+func newClient(conn *websocket.Conn) *Client {
+	return &Client{
+		Conn:    conn,
+		send:    make(chan []byte, sendBufferSize),
+		stopped: make(chan struct{}),
+	}
+}
+
+// delivery is a pre-encoded event and the receivers it is meant for. When
+// users is set only those users' sessions are considered; a nil match
+// accepts every candidate.
+type delivery struct {
+	frame  encodedEvent
+	users  []uint
+	except uint // a user to skip, 0 for none
+	match  func(*Client) bool
+}
+
+// Hub owns the set of connected clients. All registration, fan-out and
+// lookups go through its goroutine, so no client is ever written to by more
+// than one goroutine and a slow client can't stall the others.
+//
+// Deliveries without a match function are also published through the
+// broker, so the hubs of other nodes hand them to their own clients.
+type Hub struct {
+	clients    map[*Client]bool
+	sessions   map[uint]map[*Client]bool // every open connection of each user
+	register   chan *Client
+	unregister chan *Client
+	deliver    chan delivery
+	exec       chan func(map[*Client]bool)
+
+	node    string
+	broker  Broker
+	inbound chan busEvent          // events from other nodes
+	outbox  chan busEvent          // events waiting to be published
+	remote  map[string]*remoteNode // other nodes by ID
+}
+
+var hub = newHub(newMemoryBroker())
+
+func newHub(broker Broker) *Hub {
+	return &Hub{
+		clients:    make(map[*Client]bool),
+		sessions:   make(map[uint]map[*Client]bool),
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		deliver:    make(chan delivery, sendBufferSize),
+		exec:       make(chan func(map[*Client]bool)),
+
+		node:    newNodeID(),
+		broker:  broker,
+		inbound: make(chan busEvent, sendBufferSize),
+		outbox:  make(chan busEvent, sendBufferSize),
+		remote:  make(map[string]*remoteNode),
+	}
+}
+
+func (h *Hub) run() {
+	h.broker.Subscribe(h.receive)
+	go h.publishLoop()
+
+	// Ask the other nodes who they have connected, and tell them we're
+	// here.
+	h.publish(busEvent{Kind: busHello})
+
+	heartbeat := time.NewTicker(presenceSyncInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case c := <-h.register:
+			h.add(c)
+
+		case c := <-h.unregister:
+			h.remove(c)
+
+		case d := <-h.deliver:
+			h.dispatch(d)
+
+		case fn := <-h.exec:
+			fn(h.clients)
+
+		case ev := <-h.inbound:
+			h.handleRemote(ev)
+
+		case now := <-heartbeat.C:
+			h.publish(h.syncEvent())
+			h.expireNodes(now)
+		}
+	}
+}
+
+// dispatch hands a frame to every matching client, evicting those whose
+// buffer is full. It runs on the hub goroutine.
+func (h *Hub) dispatch(d delivery) {
+	if d.users == nil {
+		for c := range h.clients {
+			h.offer(c, d)
+		}
+		return
+	}
+
+	for _, id := range d.users {
+		for c := range h.sessions[id] {
+			h.offer(c, d)
+		}
+	}
+}
+
+func (h *Hub) offer(c *Client, d delivery) {
+	if d.match != nil && !d.match(c) || d.except != 0 && c.UserID == d.except {
+		return
+	}
+	select {
+	case c.send <- d.frame.forClient(c):
+	default:
+		log.Printf("evicting %s: send buffer full", c.Username)
+		h.remove(c)
+	}
+}
+
+// add registers c. The user's first session on any node announces them to
+// everyone.
+func (h *Hub) add(c *Client) {
+	h.updatePresence(c.UserID, c.Username, func() {
+		set := h.sessions[c.UserID]
+		if set == nil {
+			set = make(map[*Client]bool)
+			h.sessions[c.UserID] = set
+		}
+		set[c] = true
+		h.clients[c] = true
+	})
+}
+
+// remove drops c from the hub and closes its send channel, which makes the
+// write pump close the connection. The user's last session on any node
+// announces that they left.
+func (h *Hub) remove(c *Client) {
+	if _, ok := h.clients[c]; !ok {
+		return
+	}
+
+	h.updatePresence(c.UserID, c.Username, func() {
+		delete(h.clients, c)
+		close(c.send)
+
+		set := h.sessions[c.UserID]
+		delete(set, c)
+		if len(set) == 0 {
+			delete(h.sessions, c.UserID)
+		}
+	})
+}
+
+// send encodes ev once and queues it for every client matching match. A
+// nil match reaches every client on every node; otherwise only this node's
+// clients are considered.
+func (h *Hub) send(ev serverEvent, match func(*Client) bool) {
+	d := delivery{frame: encodeEvent(ev), match: match}
+	h.deliver <- d
+	if match == nil {
+		h.publish(d.busEvent())
+	}
+}
+
+// sendExcept queues ev for every client on every node except the sessions
+// of userID.
+func (h *Hub) sendExcept(ev serverEvent, userID uint) {
+	d := delivery{frame: encodeEvent(ev), except: userID}
+	h.deliver <- d
+	h.publish(d.busEvent())
+}
+
+// sendToUsers queues ev for every session of the given users, on every
+// node.
+func (h *Hub) sendToUsers(ev serverEvent, userIDs ...uint) {
+	if len(userIDs) == 0 {
+		// An empty users list would mean everyone to dispatch.
+		return
+	}
+	d := delivery{frame: encodeEvent(ev), users: userIDs}
+	h.deliver <- d
+	h.publish(d.busEvent())
+}
+
+// mustEncode marshals a value built from plain structs, so a failure is a
+// programming error.
+func mustEncode(v interface{}) []byte {
+	frame, err := json.Marshal(v)
+	if err != nil {
+		log.Panicln("encode frame:", err)
+	}
+	return frame
+}
+
+// sendTo queues ev for a single client of this node. Only the sessions of
+// its user are looked at, so replies don't cost a pass over every client.
+func (h *Hub) sendTo(c *Client, ev serverEvent) {
+	h.deliver <- delivery{
+		frame: encodeEvent(ev),
+		users: []uint{c.UserID},
+		match: func(other *Client) bool { return other == c },
+	}
+}
+
+// do runs fn on the hub goroutine and waits for it to finish. fn must not
+// block or call back into the hub.
+func (h *Hub) do(fn func(clients map[*Client]bool)) {
+	done := make(chan struct{})
+	h.exec <- func(clients map[*Client]bool) {
+		fn(clients)
+		close(done)
+	}
+	<-done
+}
+
+// ================= PUMPS =================
+
+// queue writes ev straight onto the client's buffer, waiting for room. It
+// may only be used before the client is registered, while nothing else can
+// close send. It reports false once the client's writer has exited, as
+// nothing will drain the buffer any more.
+func (c *Client) queue(ev serverEvent) bool {
+	select {
+	case c.send <- encodeEvent(ev).forClient(c):
+		return true
+	case <-c.stopped:
+		return false
+	}
+}
+
+// writePump is the only goroutine that writes data frames to the
+// connection. It also keeps the connection alive with pings.
+func (c *Client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.Conn.Close()
+		close(c.stopped)
+	}()
+
+	for {
+		select {
+		case frame, ok := <-c.send:
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				// The hub closed the channel.
+				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.Conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+				return
+			}
+
+		case <-ticker.C:
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// keepAlive makes reads fail if the peer stops answering pings.
+func (c *Client) keepAlive() {
+	c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.Conn.SetPongHandler(func(string) error {
+		c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+}
@@ -1,238 +1,595 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/rand"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
-	"sync"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/websocket"
-	"gorm.io/driver/postgres"
-	"gorm.io/gorm"
+	"golang.org/x/crypto/bcrypt"
 )
 
-var jwtSecret = []byte("super_secret_key_change_me")
+var jwtSecret = []byte(defaultJWTSecret)
 
-var db *gorm.DB
-
-// Thread-safe client registry
-type Client struct {
-	Conn     *websocket.Conn
-	Username string
-	UserID   uint
-}
-
-var (
-	clients   = make(map[*websocket.Conn]*Client)
-	clientsMu sync.RWMutex
-)
+var store Store
 
 // WebSocket upgrader
 var upgrader = websocket.Upgrader{
+	Subprotocols: []string{protocolV1},
 	CheckOrigin: func(r *http.Request) bool {
-		return r.Host == "localhost:8080"
+		// Non-browser clients don't send an Origin header.
+		origin := r.Header.Get("Origin")
+		return origin == "" || config.originAllowed(origin)
 	},
 }
 
 type User struct {
-	ID       uint   `gorm:"primaryKey"`
-	Username string `gorm:"unique;not null"`
+	ID           uint   `gorm:"primaryKey"`
+	Username     string `gorm:"unique;not null"`
+	PasswordHash string `gorm:"not null;default:''"`
+	LastSeen     *time.Time
+	CreatedAt    time.Time
 }
 
 type Message struct {
-	ID        uint `gorm:"primaryKey"`
-	SenderID  uint
-	Content   string
-	Timestamp time.Time
+	ID         uint `gorm:"primaryKey"`
+	SenderID   uint
+	ReceiverID *uint // set for direct messages
+	RoomID     *uint // set for room messages
+	Content    string
+	Timestamp  time.Time
+	ParentID   *uint `gorm:"index"` // set for thread replies
+	EditedAt   *time.Time
+	DeletedAt  *time.Time // tombstone marker; the row is kept so history stays in order
+
+	Attachments []Attachment `gorm:"foreignKey:MessageID"`
 }
 
 // ================= DATABASE =================
 
-func initDB() {
-	dsn := "host=localhost user=postgres password=postgres dbname=chatapp port=5432 sslmode=disable"
+// initStore opens the configured store (postgres, sqlite or memory).
+func initStore(c storeConfig) {
 	var err error
-	db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	store, err = openStore(c.Driver, c.DSN)
 	if err != nil {
 		log.Fatal("DB connection failed:", err)
 	}
-
-	db.AutoMigrate(&User{}, &Message{})
 }
 
 // ================= JWT =================
 
-func generateJWT(username string) (string, error) {
-	claims := jwt.MapClaims{
-		"username": username,
-		"exp":      time.Now().Add(72 * time.Hour).Unix(),
+// Access tokens are short-lived; clients renew them with a refresh token.
+const accessTokenTTL = 15 * time.Minute
+
+var errTokenRevoked = errors.New("token revoked")
+
+type accessClaims struct {
+	Username string `json:"username"`
+	Family   string `json:"fam"`
+	jwt.RegisteredClaims
+}
+
+func generateJWT(username, family string) (string, time.Time, error) {
+	now := time.Now()
+	expires := now.Add(accessTokenTTL)
+
+	claims := accessClaims{
+		Username: username,
+		Family:   family,
+		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expires),
+		},
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	signed, err := token.SignedString(jwtSecret)
+	return signed, expires, err
 }
 
-func validateJWT(tokenString string) (string, error) {
-	token, err := jwt.Parse(tokenString, func(t *jwt.Token) (interface{}, error) {
+// validateJWT parses an access token and rejects it if it has expired or
+// its refresh family has been revoked.
+func validateJWT(tokenString string) (*accessClaims, error) {
+	claims := &accessClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
 		return jwtSecret, nil
-	})
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
 
-	if err != nil || !token.Valid {
-		return "", err
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid || claims.Username == "" {
+		return nil, errors.New("invalid token")
 	}
 
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		return "", err
+	if familyRevoked(claims.Family) {
+		return nil, errTokenRevoked
 	}
 
-	username, ok := claims["username"].(string)
-	if !ok {
-		return "", err
+	return claims, nil
+}
+
+// requireAuth resolves the bearer token in the Authorization header to a
+// user before calling next.
+func requireAuth(next func(http.ResponseWriter, *http.Request, User)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, user, err := authenticateRequest(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r, user)
 	}
+}
 
-	return username, nil
+// authenticateRequest validates the bearer token in the Authorization
+// header and loads its user.
+func authenticateRequest(r *http.Request) (*accessClaims, User, error) {
+	return authenticateToken(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+}
+
+// authenticateToken validates an access token and loads its user.
+func authenticateToken(token string) (*accessClaims, User, error) {
+	claims, err := validateJWT(token)
+	if err != nil {
+		return nil, User{}, err
+	}
+
+	user, err := store.UserByName(claims.Username)
+	return claims, user, err
 }
 
 // ================= HANDLERS =================
 
-func authHandler(w http.ResponseWriter, r *http.Request) {
-	username := r.URL.Query().Get("username")
-	if username == "" {
-		http.Error(w, "Username required", http.StatusBadRequest)
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{3,32}$`)
+
+const minPasswordLength = 8
+
+// dummyHash is compared against when a login names an unknown user or one
+// without a password, so the response time doesn't reveal which. It hashes
+// random bytes, so no password matches it.
+var dummyHash = func() []byte {
+	password := make([]byte, 32)
+	if _, err := rand.Read(password); err != nil {
+		log.Panicln("dummy password:", err)
+	}
+	hash, err := bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
+	if err != nil {
+		log.Panicln("dummy password hash:", err)
+	}
+	return hash
+}()
+
+type credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func registerHandler(w http.ResponseWriter, r *http.Request) {
+	var req credentials
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	// Create user if not exists
-	var user User
-	db.FirstOrCreate(&user, User{Username: username})
+	if !usernamePattern.MatchString(req.Username) {
+		http.Error(w, "Username must be 3-32 letters, digits, '.', '_' or '-'", http.StatusBadRequest)
+		return
+	}
+	if len(req.Password) < minPasswordLength {
+		http.Error(w, "Password must be at least 8 characters", http.StatusBadRequest)
+		return
+	}
+	// bcrypt ignores everything past 72 bytes
+	if len(req.Password) > 72 {
+		http.Error(w, "Password must be at most 72 bytes", http.StatusBadRequest)
+		return
+	}
 
-	token, err := generateJWT(username)
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 	if err != nil {
-		http.Error(w, "Token generation failed", 500)
+		http.Error(w, "Registration failed", http.StatusInternalServerError)
 		return
 	}
 
-	json.NewEncoder(w).Encode(map[string]string{"token": token})
+	user := User{Username: req.Username, PasswordHash: string(hash)}
+	err = store.CreateUser(&user)
+	if errors.Is(err, errDuplicate) {
+		http.Error(w, "Username already taken", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Registration failed", http.StatusInternalServerError)
+		return
+	}
+
+	writeTokens(w, http.StatusCreated, user, "")
 }
 
-func usersHandler(w http.ResponseWriter, r *http.Request) {
-	clientsMu.RLock()
-	defer clientsMu.RUnlock()
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	var req credentials
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
 
-	var list []string
-	for _, c := range clients {
-		list = append(list, c.Username)
+	user, err := store.UserByName(req.Username)
+
+	hash := dummyHash
+	if err == nil && user.PasswordHash != "" {
+		hash = []byte(user.PasswordHash)
+	}
+
+	// Accounts created before passwords existed have no hash and stay locked
+	// until an administrator sets one with -set-password.
+	if bcrypt.CompareHashAndPassword(hash, []byte(req.Password)) != nil || err != nil || user.PasswordHash == "" {
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+
+	writeTokens(w, http.StatusOK, user, "")
+}
+
+// setPassword sets a user's password to the first line read from in. It is
+// how an administrator unlocks an account created before passwords existed,
+// which can't log in, or resets a forgotten password.
+func setPassword(username string, in io.Reader) error {
+	user, err := store.UserByName(username)
+	if err != nil {
+		return fmt.Errorf("user %q: %w", username, err)
+	}
+
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	password := strings.TrimRight(line, "\r\n")
+	// bcrypt ignores everything past 72 bytes
+	if len(password) < minPasswordLength || len(password) > 72 {
+		return fmt.Errorf("password must be %d to 72 bytes", minPasswordLength)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
 	}
+	return store.SetPasswordHash(user.ID, string(hash))
+}
+
+// usersHandler lists each connected user once, however many sessions they
+// have open and on whichever node.
+func usersHandler(w http.ResponseWriter, r *http.Request) {
+	var list []string
+	hub.do(func(map[*Client]bool) {
+		list = hub.onlineUsers()
+	})
 
 	json.NewEncoder(w).Encode(list)
 }
 
 func wsHandler(w http.ResponseWriter, r *http.Request) {
+	if !conns.enter() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer conns.leave()
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	// First message must contain token
-	var authMsg struct {
-		Token string `json:"token"`
+	conn.SetReadLimit(maxFrameSize)
+	client := newClient(conn)
+	client.protocol = conn.Subprotocol()
+
+	// Clients that couldn't present a token with the upgrade send it, and
+	// optionally a stable device ID used to resume the offline queue, in
+	// the first frame.
+	token, device := upgradeToken(r), r.URL.Query().Get("device")
+	if token == "" {
+		conn.SetReadDeadline(time.Now().Add(authTimeout))
+		_, data, err := conn.ReadMessage()
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			client.closeWith(closeAuthTimeout, "authentication timed out")
+			return
+		}
+		if err != nil {
+			conn.Close()
+			return
+		}
+		authMsg, err := decodeAuth(client, data)
+		if err != nil {
+			client.closeWith(closeBadRequest, "first frame must be auth")
+			return
+		}
+		token, device = authMsg.Token, authMsg.Device
 	}
 
-	err = conn.ReadJSON(&authMsg)
+	claims, user, err := authenticateToken(token)
 	if err != nil {
-		conn.Close()
+		client.closeWith(closeUnauthorized, "invalid token")
+		return
+	}
+	if len(device) > maxDeviceIDLength {
+		client.closeWith(closeBadRequest, "device ID too long")
 		return
 	}
 
-	username, err := validateJWT(authMsg.Token)
+	client.keepAlive()
+	client.identify(user, claims, device)
+	go client.writePump()
+	startSession(client)
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		client.handleFrame(data)
+	}
+
+	// Remove on disconnect; the write pump closes the connection.
+	endSession(client)
+}
+
+// identify records who an authenticated client is.
+func (c *Client) identify(user User, claims *accessClaims, device string) {
+	c.Username = user.Username
+	c.UserID = user.ID
+	c.Family = claims.Family
+	c.Device = device
+	c.extendSession(claims.ExpiresAt.Time)
+}
+
+// startSession queues what the client's device missed and registers it
+// with the hub. The client's writer must already be draining its send
+// buffer.
+func startSession(client *Client) {
+	// Queue history before registering so replay frames don't interleave
+	// with live broadcasts on the same connection. A device we've seen
+	// before only gets what it missed; anything else gets the usual window.
+	cursor, known := loadDeviceCursor(client.UserID, client.Device)
+	var flushed uint
+	if known {
+		flushed = flushOffline(client, cursor.LastMessageID)
+	} else {
+		flushed = latestReceiptID(client.UserID)
+		replayHistory(client)
+		if client.Device != "" {
+			startDevice(client.UserID, client.Device, flushed)
+		}
+	}
+
+	hub.register <- client
+	if conns.isDraining() {
+		// Shutdown started after this session was admitted and may have
+		// missed it when closing sockets.
+		client.closeWith(websocket.CloseServiceRestart, "server restarting")
+	}
+	catchUpOffline(client, flushed)
+}
+
+// endSession unregisters a client whose connection has gone.
+func endSession(client *Client) {
+	client.expiry.Stop()
+	stopTypingAll(client.UserID)
+	store.SetLastSeen(client.UserID, time.Now())
+	hub.unregister <- client
+}
+
+// handleFrame decodes and acts on one frame from the client.
+func (c *Client) handleFrame(data []byte) {
+	typ, id, ev, err := decodeClientEvent(c, data)
+	c.frameID = id
 	if err != nil {
-		conn.Close()
+		sendDecodeError(c, err)
 		return
 	}
 
-	// Fetch user
-	var user User
-	db.First(&user, "username = ?", username)
-
-	client := &Client{
-		Conn:     conn,
-		Username: username,
-		UserID:   user.ID,
+	if rateLimited(typ) {
+		if t := limits.take(c.UserID); t != nil {
+			sendThrottled(c, t)
+			return
+		}
 	}
 
-	clientsMu.Lock()
-	clients[conn] = client
-	clientsMu.Unlock()
+	ev.handle(c)
+}
 
-	broadcastSystem(username + " joined the chat")
+// handleChatMessage routes a chat message to a room, a single recipient or,
+// when neither is set, everyone. A reply (ParentID set) always goes to the
+// conversation of its thread. Once stored, the sending connection gets an
+// ack pairing its temporary ClientID with the persisted message ID.
+func handleChatMessage(client *Client, in *sendMessageEvent) {
+	if strings.TrimSpace(in.Content) == "" && len(in.Attachments) == 0 {
+		sendError(client, "invalid_content", "Content required")
+		return
+	}
+	if utf8.RuneCountInString(in.Content) > maxContentLength {
+		sendError(client, "content_too_long", fmt.Sprintf("Messages are limited to %d characters", maxContentLength))
+		return
+	}
 
-	for {
-		var msg struct {
-			Content string `json:"content"`
+	draft := Message{
+		SenderID:  client.UserID,
+		Content:   in.Content,
+		Timestamp: time.Now(),
+	}
+
+	roomID, recipient := in.Room, in.Recipient
+	if in.ParentID != 0 {
+		root, ok := resolveThread(client, in.ParentID)
+		if !ok {
+			return
 		}
+		draft.ParentID = &root.ID
+		roomID, recipient = threadTarget(client, root)
+	}
 
-		err := conn.ReadJSON(&msg)
-		if err != nil {
-			break
+	if len(in.Attachments) > 0 {
+		attachments, ok := pendingAttachments(client, in.Attachments)
+		if !ok {
+			return
 		}
+		draft.Attachments = attachments
+	}
 
-		// Save to DB
-		db.Create(&Message{
-			SenderID:  client.UserID,
-			Content:   msg.Content,
-			Timestamp: time.Now(),
-		})
+	var msg *Message
+	switch {
+	case roomID != 0:
+		msg = handleRoomMessage(client, roomID, draft)
+	case recipient != "":
+		msg = handleDirectMessage(client, recipient, draft)
+	default:
+		msg = handleLobbyMessage(client, draft)
+	}
+
+	if msg == nil {
+		return
+	}
 
-		broadcastMessage(client.Username, msg.Content)
+	if msg.ParentID != nil {
+		pushThreadUpdate(*msg.ParentID)
 	}
+	recordMentions(*msg)
 
-	// Remove on disconnect
-	clientsMu.Lock()
-	delete(clients, conn)
-	clientsMu.Unlock()
+	hub.sendTo(client, ackEvent{ClientID: in.ClientID, ID: msg.ID, Timestamp: msg.Timestamp})
+}
 
-	broadcastSystem(username + " left the chat")
-	conn.Close()
+// handleLobbyMessage stores a message addressed to everyone and broadcasts
+// it.
+func handleLobbyMessage(sender *Client, msg Message) *Message {
+	if err := storeMessage(&msg, nil); err != nil {
+		sendError(sender, "internal", "Could not store message")
+		return nil
+	}
+
+	stopTyping(sender.UserID, conversation{})
+	broadcastMessage(0, sender.Username, msg)
+	return &msg
+}
+
+// handleDirectMessage stores a private message and delivers it to the
+// recipient's connections and to every session of the sender.
+func handleDirectMessage(sender *Client, recipient string, msg Message) *Message {
+	receiver, err := store.UserByName(recipient)
+	if errors.Is(err, errNotFound) {
+		sendError(sender, "unknown_recipient", "User "+recipient+" does not exist")
+		return nil
+	}
+	if err != nil {
+		sendError(sender, "internal", "Could not deliver message")
+		return nil
+	}
+
+	msg.ReceiverID = &receiver.ID
+	if err := storeMessage(&msg, []uint{receiver.ID}); err != nil {
+		sendError(sender, "internal", "Could not store message")
+		return nil
+	}
+
+	stopTyping(sender.UserID, conversation{PeerID: receiver.ID})
+
+	sendDirect(sender.Username, receiver.Username, msg)
+	return &msg
 }
 
 // ================= BROADCAST =================
 
-func broadcastMessage(sender, content string) {
-	clientsMu.RLock()
-	defer clientsMu.RUnlock()
+// sendDirect delivers a private message to both participants. The sender's
+// own connections receive the echo so every open tab shows the message.
+func sendDirect(sender, recipient string, msg Message) {
+	message := directMessageEvent{
+		ID:          msg.ID,
+		Sender:      sender,
+		Recipient:   recipient,
+		Content:     msg.Content,
+		Timestamp:   msg.Timestamp,
+		ParentID:    derefID(msg.ParentID),
+		Attachments: attachmentViews(msg.Attachments),
+	}
+
+	hub.sendToUsers(message, msg.SenderID, *msg.ReceiverID)
+}
 
-	message := map[string]string{
-		"type":    "message",
-		"sender":  sender,
-		"content": content,
+// sendError reports a problem with the frame c is handling.
+func sendError(c *Client, code, content string) {
+	c.refuse(errorEvent{Code: code, Content: content, Ref: c.frameID})
+}
+
+// refuse tells the client why the frame it is handling was refused. A
+// frame POSTed for an event stream is answered in the response instead.
+func (c *Client) refuse(ev errorEvent) {
+	if c.stream != nil {
+		c.stream.refused = &ev
+		return
 	}
+	hub.sendTo(c, ev)
+}
 
-	for _, c := range clients {
-		c.Conn.WriteJSON(message)
+// broadcastMessage sends a chat message to the members of roomID, or to
+// every connected client when roomID is 0.
+func broadcastMessage(roomID uint, sender string, msg Message) {
+	message := chatMessageEvent{
+		ID:          msg.ID,
+		Sender:      sender,
+		Room:        roomID,
+		Content:     msg.Content,
+		Timestamp:   msg.Timestamp,
+		ParentID:    derefID(msg.ParentID),
+		Attachments: attachmentViews(msg.Attachments),
 	}
+
+	broadcastToRoom(roomID, message)
 }
 
-func broadcastSystem(content string) {
-	clientsMu.RLock()
-	defer clientsMu.RUnlock()
+// broadcastSystem sends a system notice to the members of roomID, or to
+// every connected client when roomID is 0.
+func broadcastSystem(roomID uint, content string) {
+	broadcastToRoom(roomID, systemEvent{Content: content, Room: roomID})
+}
 
-	message := map[string]string{
-		"type":    "system",
-		"content": content,
+func broadcastToRoom(roomID uint, message serverEvent) {
+	if roomID == 0 {
+		hub.send(message, nil)
+		return
 	}
 
-	for _, c := range clients {
-		c.Conn.WriteJSON(message)
+	members := roomMemberIDs(roomID)
+	ids := make([]uint, 0, len(members))
+	for id := range members {
+		ids = append(ids, id)
 	}
+	hub.sendToUsers(message, ids...)
 }
+
 func enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-
-		w.Header().Set("Access-Control-Allow-Origin", "http://127.0.0.1:5500")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Add("Vary", "Origin")
+		if origin := r.Header.Get("Origin"); origin != "" && config.originAllowed(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 
 		if r.Method == "OPTIONS" {
@@ -246,14 +603,108 @@ func enableCORS(next http.Handler) http.Handler {
 
 // ================= MAIN =================
 
-func main() {
-	initDB()
-
+// routes builds the HTTP API.
+func routes() *http.ServeMux {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/auth", authHandler)
+	mux.HandleFunc("POST /register", registerHandler)
+	mux.HandleFunc("POST /login", loginHandler)
+	mux.HandleFunc("POST /token/refresh", refreshHandler)
+	mux.HandleFunc("POST /logout", logoutHandler)
 	mux.HandleFunc("/ws", wsHandler)
+	mux.HandleFunc("GET /events", eventsHandler)
+	mux.HandleFunc("POST /events", requireAuth(postEventHandler))
+	mux.HandleFunc("GET /poll", pollHandler)
 	mux.HandleFunc("/users", usersHandler)
+	mux.HandleFunc("GET /messages", requireAuth(messagesHandler))
+	mux.HandleFunc("PATCH /messages/{id}", requireAuth(editMessageHandler))
+	mux.HandleFunc("DELETE /messages/{id}", requireAuth(deleteMessageHandler))
+	mux.HandleFunc("GET /messages/{id}/edits", requireAuth(messageEditsHandler))
+	mux.HandleFunc("GET /messages/{id}/thread", requireAuth(threadHandler))
+	mux.HandleFunc("POST /attachments", requireAuth(uploadHandler))
+	mux.HandleFunc("GET /attachments/{id}", requireAuth(downloadHandler))
+	mux.HandleFunc("GET /search", requireAuth(searchHandler))
+	mux.HandleFunc("GET /notifications", requireAuth(notificationsHandler))
+	mux.HandleFunc("POST /notifications/read", requireAuth(markNotificationsReadHandler))
+	mux.HandleFunc("GET /rooms", requireAuth(listRoomsHandler))
+	mux.HandleFunc("POST /rooms", requireAuth(createRoomHandler))
+	mux.HandleFunc("PATCH /rooms/{id}", requireAuth(updateRoomHandler))
+	mux.HandleFunc("POST /rooms/{id}/join", requireAuth(joinRoomHandler))
+	mux.HandleFunc("POST /rooms/{id}/leave", requireAuth(leaveRoomHandler))
+	mux.HandleFunc("GET /rooms/{id}/members", requireAuth(roomMembersHandler))
+	mux.HandleFunc("PUT /rooms/{id}/members/{user}/role", requireAuth(setRoleHandler))
+	mux.HandleFunc("POST /rooms/{id}/kick", requireAuth(kickHandler))
+	mux.HandleFunc("POST /rooms/{id}/bans", requireAuth(banHandler))
+	mux.HandleFunc("DELETE /rooms/{id}/bans/{user}", requireAuth(liftSanctionHandler(sanctionBan)))
+	mux.HandleFunc("POST /rooms/{id}/mutes", requireAuth(muteHandler))
+	mux.HandleFunc("DELETE /rooms/{id}/mutes/{user}", requireAuth(liftSanctionHandler(sanctionMute)))
+	mux.HandleFunc("GET /rooms/{id}/pins", requireAuth(pinsHandler))
+	mux.HandleFunc("POST /rooms/{id}/pins", requireAuth(pinHandler))
+	mux.HandleFunc("DELETE /rooms/{id}/pins/{message}", requireAuth(unpinHandler))
+	mux.HandleFunc("GET /rooms/{id}/audit", requireAuth(moderationLogHandler))
+	return mux
+}
+
+func main() {
+	configPath := flag.String("config", os.Getenv("CHAT_CONFIG"), "path to a YAML or TOML config file")
+	schemaPath := flag.String("schema", "", "write the websocket protocol's JSON Schema to this file and exit")
+	setPasswordOf := flag.String("set-password", "", "set this user's password to a line read from stdin and exit")
+	flag.Parse()
+
+	if *schemaPath != "" {
+		if err := writeProtocolSchema(*schemaPath); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	var err error
+	config, err = loadConfig(*configPath)
+	if err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+	if config.JWTSecret == defaultJWTSecret {
+		log.Println("WARNING: using the default JWT secret; set CHAT_JWT_SECRET before deploying")
+	}
+	log.Println("Config:", config)
+
+	jwtSecret = []byte(config.JWTSecret)
+	initStore(config.Store)
+	if *setPasswordOf != "" {
+		if err := setPassword(*setPasswordOf, os.Stdin); err != nil {
+			log.Fatal("Setting password failed: ", err)
+		}
+		log.Println("Password set for", *setPasswordOf)
+		return
+	}
+	blobs = newLocalBlobStore(config.UploadDir)
+
+	broker, err := openBroker(config.Broker)
+	if err != nil {
+		log.Fatal("Broker connection failed: ", err)
+	}
+	hub = newHub(broker)
+	go hub.run()
+
+	srv := &http.Server{Addr: config.Addr, Handler: enableCORS(routes())}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Println("Server running on", config.Addr)
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+	stop() // a second signal kills the process immediately
 
-	log.Println("Server running on :8080")
-	log.Fatal(http.ListenAndServe(":8080", enableCORS(mux)))
+	log.Println("Shutting down...")
+	drainCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	shutdown(drainCtx, srv)
+	log.Println("Server stopped")
 }
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Mentions beyond this many distinct names in one message are ignored.
+	maxMentionsPerMessage = 20
+
+	notificationsDefaultLimit = 50
+)
+
+// mentionPattern matches @username tokens; names follow usernamePattern.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@])@([A-Za-z0-9_.-]{3,32})`)
+
+// Mention records that a message named a user, and doubles as that user's
+// notification.
+type Mention struct {
+	ID        uint `gorm:"primaryKey"`
+	MessageID uint `gorm:"uniqueIndex:idx_mention_message_user;not null"`
+	UserID    uint `gorm:"uniqueIndex:idx_mention_message_user;index;not null"`
+	CreatedAt time.Time
+	ReadAt    *time.Time
+}
+
+// mentionedNames extracts the distinct @names in content, as written.
+func mentionedNames(content string) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, m := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		name := m[1]
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+		if len(names) == maxMentionsPerMessage {
+			break
+		}
+	}
+	return names
+}
+
+// mentionedUsers looks up the users named in content. Trailing dots are
+// punctuation only where no user's name includes them, so "thanks @bob."
+// mentions bob unless there is a "bob.".
+func mentionedUsers(content string) []User {
+	names := mentionedNames(content)
+	if len(names) == 0 {
+		return nil
+	}
+
+	var lookup []string
+	for _, name := range names {
+		lookup = append(lookup, dotTrimmed(name)...)
+	}
+	found, _ := store.UsersByName(lookup)
+	byName := make(map[string]User, len(found))
+	for _, u := range found {
+		byName[u.Username] = u
+	}
+
+	seen := make(map[uint]bool)
+	var users []User
+	for _, name := range names {
+		for _, candidate := range dotTrimmed(name) {
+			u, ok := byName[candidate]
+			if !ok {
+				continue
+			}
+			if !seen[u.ID] {
+				seen[u.ID] = true
+				users = append(users, u)
+			}
+			break
+		}
+	}
+	return users
+}
+
+// dotTrimmed lists name and each shorter name left by dropping its trailing
+// dots one at a time, longest first.
+func dotTrimmed(name string) []string {
+	names := []string{name}
+	for strings.HasSuffix(name, ".") && len(name) > 3 {
+		name = name[:len(name)-1]
+		names = append(names, name)
+	}
+	return names
+}
+
+// recordMentions stores a mention for every user named in m who can see it
+// and pushes a mention event to their sessions, wherever they are. Users
+// already mentioned by an earlier version of m are not notified again.
+func recordMentions(m Message) {
+	for _, u := range mentionedUsers(m.Content) {
+		if u.ID == m.SenderID || !canViewMessage(u.ID, m) {
+			continue
+		}
+
+		mention := Mention{MessageID: m.ID, UserID: u.ID}
+		created, err := store.CreateMention(&mention)
+		if err != nil || !created {
+			continue
+		}
+
+		hub.sendToUsers(mentionEvent{
+			ID:        mention.ID,
+			Message:   toMessageViews(u.ID, []Message{m})[0],
+			CreatedAt: mention.CreatedAt,
+		}, u.ID)
+	}
+}
+
+// ================= NOTIFICATION HANDLERS =================
+
+type notificationView struct {
+	ID        uint        `json:"id"`
+	Message   messageView `json:"message"`
+	CreatedAt time.Time   `json:"created_at"`
+	Read      bool        `json:"read"`
+}
+
+// notificationsHandler serves GET /notifications?unread=true&limit=, newest
+// first, with the total number of unread notifications.
+func notificationsHandler(w http.ResponseWriter, r *http.Request, user User) {
+	limit := notificationsDefaultLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, historyMaxLimit)
+	}
+
+	unread, _ := store.UnreadMentions(user.ID)
+
+	mentions, err := store.Mentions(user.ID, r.URL.Query().Get("unread") == "true", limit)
+	if err != nil {
+		http.Error(w, "Could not load notifications", http.StatusInternalServerError)
+		return
+	}
+
+	ids := make([]uint, 0, len(mentions))
+	for _, m := range mentions {
+		ids = append(ids, m.MessageID)
+	}
+	msgs, _ := store.MessagesByID(ids)
+	views := make(map[uint]messageView, len(msgs))
+	for _, v := range toMessageViews(user.ID, msgs) {
+		views[v.ID] = v
+	}
+
+	list := make([]notificationView, 0, len(mentions))
+	for _, m := range mentions {
+		list = append(list, notificationView{
+			ID:        m.ID,
+			Message:   views[m.MessageID],
+			CreatedAt: m.CreatedAt,
+			Read:      m.ReadAt != nil,
+		})
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"unread_count":  unread,
+		"notifications": list,
+	})
+}
+
+// markNotificationsReadHandler serves POST /notifications/read. It marks the
+// listed notifications read, or all of them when ids is empty.
+func markNotificationsReadHandler(w http.ResponseWriter, r *http.Request, user User) {
+	var req struct {
+		IDs []uint `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := store.MarkMentionsRead(user.ID, req.IDs, time.Now()); err != nil {
+		http.Error(w, "Could not update notifications", http.StatusInternalServerError)
+		return
+	}
+
+	unread, _ := store.UnreadMentions(user.ID)
+
+	// Keep badges on the user's other devices in step.
+	hub.sendToUsers(notificationsReadEvent{IDs: req.IDs, UnreadCount: unread}, user.ID)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"unread_count": unread})
+}
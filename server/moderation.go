@@ -0,0 +1,767 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Roles a room member can hold. A room's creator is always its owner.
+// Moderators can kick, ban and mute members, delete their messages and pin
+// messages; only the owner can make or unmake moderators.
+const (
+	roleMember    = "member"
+	roleModerator = "moderator"
+	roleOwner     = "owner"
+)
+
+var roleRanks = map[string]int{roleMember: 1, roleModerator: 2, roleOwner: 3}
+
+// Kinds of RoomSanction.
+const (
+	sanctionBan  = "ban"
+	sanctionMute = "mute"
+)
+
+// Actions recorded in the moderation log.
+const (
+	actionSetRole  = "set_role"
+	actionKick     = "kick"
+	actionBan      = "ban"
+	actionUnban    = "unban"
+	actionMute     = "mute"
+	actionUnmute   = "unmute"
+	actionDelete   = "delete_message"
+	actionPin      = "pin"
+	actionUnpin    = "unpin"
+	actionSlowMode = "slow_mode"
+)
+
+const (
+	// maxSanctionDuration is the longest timed ban or mute, in seconds.
+	// Longer ones are left open until lifted.
+	maxSanctionDuration = 365 * 24 * 60 * 60
+
+	maxReasonLength = 500
+
+	moderationLogDefaultLimit = 50
+)
+
+// RoomSanction bans a user from a room or mutes them in it until ExpiresAt,
+// or until it is lifted when ExpiresAt is nil.
+type RoomSanction struct {
+	RoomID    uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"primaryKey"`
+	Kind      string `gorm:"primaryKey"`
+	ByID      uint
+	Reason    string
+	ExpiresAt *time.Time
+	CreatedAt time.Time
+}
+
+// RoomPin marks a message as pinned in its room.
+type RoomPin struct {
+	RoomID    uint `gorm:"primaryKey"`
+	MessageID uint `gorm:"primaryKey"`
+	PinnedBy  uint
+	PinnedAt  time.Time
+}
+
+// ModerationEntry is one record of a room's moderation log.
+type ModerationEntry struct {
+	ID        uint   `gorm:"primaryKey"`
+	RoomID    uint   `gorm:"index;not null"`
+	ActorID   uint   `gorm:"not null"`
+	Action    string `gorm:"not null"`
+	TargetID  *uint  // the user acted on
+	MessageID *uint  // the message deleted, pinned or unpinned
+	Detail    string // the role given or slow mode set
+	Reason    string
+	ExpiresAt *time.Time // when a ban or mute ends
+	CreatedAt time.Time
+}
+
+var (
+	errNotModerator     = errors.New("not a moderator of the room")
+	errNotOwner         = errors.New("not the owner of the room")
+	errUnknownUser      = errors.New("unknown user")
+	errNotInRoom        = errors.New("user is not a member of the room")
+	errMutedInRoom      = errors.New("user is muted in the room")
+	errOutranked        = errors.New("user's role is not below the moderator's")
+	errNotSanctioned    = errors.New("user is not banned or muted")
+	errInvalidRole      = errors.New("invalid role")
+	errInvalidDuration  = errors.New("invalid duration")
+	errReasonTooLong    = errors.New("reason too long")
+	errNotInThisRoom    = errors.New("message is not in the room")
+	errMessageNotPinned = errors.New("message is not pinned")
+)
+
+// roomRole returns the user's role in room, or "" if they aren't a member.
+func roomRole(room Room, userID uint) string {
+	role, err := store.RoomRole(room.ID, userID)
+	if err != nil {
+		return ""
+	}
+	if room.CreatedBy == userID {
+		return roleOwner
+	}
+	return role
+}
+
+func isRoomModerator(room Room, userID uint) bool {
+	return roleRanks[roomRole(room, userID)] >= roleRanks[roleModerator]
+}
+
+// activeSanction loads the user's ban or mute in a room if it hasn't
+// expired.
+func activeSanction(roomID, userID uint, kind string) (RoomSanction, bool) {
+	s, err := store.Sanction(roomID, userID, kind)
+	if err != nil || (s.ExpiresAt != nil && !time.Now().Before(*s.ExpiresAt)) {
+		return s, false
+	}
+	return s, true
+}
+
+// canPostToRoom checks that the user may still write to a room, as
+// handleRoomMessage does: they must be a member and not muted.
+func canPostToRoom(roomID, userID uint) error {
+	if !isRoomMember(roomID, userID) {
+		return errNotInRoom
+	}
+	if _, muted := activeSanction(roomID, userID, sanctionMute); muted {
+		return errMutedInRoom
+	}
+	return nil
+}
+
+// moderator is a user acting on a room with the powers of their role.
+type moderator struct {
+	room Room
+	user User
+	role string
+}
+
+func moderatorOf(room Room, user User) (moderator, error) {
+	m := moderator{room: room, user: user, role: roomRole(room, user.ID)}
+	if roleRanks[m.role] < roleRanks[roleModerator] {
+		return m, errNotModerator
+	}
+	return m, nil
+}
+
+// outranks reports whether the moderator may act on userID. Nobody may act
+// on themselves or on someone of equal or higher role.
+func (m moderator) outranks(userID uint) bool {
+	return userID != m.user.ID && roleRanks[m.role] > roleRanks[roomRole(m.room, userID)]
+}
+
+// target loads the user named username for the moderator to act on.
+func (m moderator) target(username string) (User, error) {
+	u, err := store.UserByName(username)
+	if errors.Is(err, errNotFound) {
+		return u, errUnknownUser
+	}
+	if err != nil {
+		return u, err
+	}
+	if !m.outranks(u.ID) {
+		return u, errOutranked
+	}
+	return u, nil
+}
+
+// record appends the action to the room's moderation log.
+func (m moderator) record(e ModerationEntry) {
+	e.RoomID = m.room.ID
+	e.ActorID = m.user.ID
+	e.CreatedAt = time.Now()
+	if err := store.AppendModerationLog(&e); err != nil {
+		log.Printf("moderation log of room %d: %v", m.room.ID, err)
+	}
+}
+
+// setRole makes a member a moderator or a plain member again. Only the
+// owner may.
+func (m moderator) setRole(username, role string) error {
+	if m.role != roleOwner {
+		return errNotOwner
+	}
+	if role != roleModerator && role != roleMember {
+		return errInvalidRole
+	}
+	u, err := m.target(username)
+	if err != nil {
+		return err
+	}
+
+	err = store.SetRoomRole(m.room.ID, u.ID, role)
+	if errors.Is(err, errNotFound) {
+		return errNotInRoom
+	}
+	if err != nil {
+		return err
+	}
+
+	m.record(ModerationEntry{Action: actionSetRole, TargetID: &u.ID, Detail: role})
+	broadcastSystem(m.room.ID, fmt.Sprintf("%s is now a %s of %s", u.Username, role, m.room.Name))
+	return nil
+}
+
+// kick removes a member from the room. Unlike a ban it doesn't stop them
+// rejoining.
+func (m moderator) kick(username, reason string) error {
+	u, err := m.target(username)
+	if err != nil {
+		return err
+	}
+	if !isRoomMember(m.room.ID, u.ID) {
+		return errNotInRoom
+	}
+
+	// Announce first so the member hears why they left.
+	broadcastSystem(m.room.ID, withReason(fmt.Sprintf("%s was removed from %s by %s", u.Username, m.room.Name, m.user.Username), reason))
+	if _, err := store.RemoveRoomMember(m.room.ID, u.ID); err != nil {
+		return err
+	}
+	stopTyping(u.ID, conversation{RoomID: m.room.ID})
+
+	m.record(ModerationEntry{Action: actionKick, TargetID: &u.ID, Reason: reason})
+	return nil
+}
+
+// ban removes the user from the room, if they are in it, and keeps them
+// from rejoining for duration seconds, or until unbanned when it is 0.
+// Users who never joined can be banned too.
+func (m moderator) ban(username, reason string, duration int) error {
+	u, err := m.target(username)
+	if err != nil {
+		return err
+	}
+
+	sanction := RoomSanction{RoomID: m.room.ID, UserID: u.ID, Kind: sanctionBan, ByID: m.user.ID, Reason: reason, ExpiresAt: sanctionEnd(duration)}
+	if err := store.SetSanction(sanction); err != nil {
+		return err
+	}
+	if isRoomMember(m.room.ID, u.ID) {
+		broadcastSystem(m.room.ID, withReason(fmt.Sprintf("%s was banned from %s by %s", u.Username, m.room.Name, m.user.Username), reason))
+		if _, err := store.RemoveRoomMember(m.room.ID, u.ID); err != nil {
+			return err
+		}
+		stopTyping(u.ID, conversation{RoomID: m.room.ID})
+	}
+
+	m.record(ModerationEntry{Action: actionBan, TargetID: &u.ID, Reason: reason, ExpiresAt: sanction.ExpiresAt})
+	return nil
+}
+
+// mute stops a member posting to the room for duration seconds, or until
+// unmuted when it is 0. They keep receiving its messages.
+func (m moderator) mute(username, reason string, duration int) error {
+	u, err := m.target(username)
+	if err != nil {
+		return err
+	}
+	if !isRoomMember(m.room.ID, u.ID) {
+		return errNotInRoom
+	}
+
+	sanction := RoomSanction{RoomID: m.room.ID, UserID: u.ID, Kind: sanctionMute, ByID: m.user.ID, Reason: reason, ExpiresAt: sanctionEnd(duration)}
+	if err := store.SetSanction(sanction); err != nil {
+		return err
+	}
+	stopTyping(u.ID, conversation{RoomID: m.room.ID})
+
+	m.record(ModerationEntry{Action: actionMute, TargetID: &u.ID, Reason: reason, ExpiresAt: sanction.ExpiresAt})
+	broadcastSystem(m.room.ID, withReason(fmt.Sprintf("%s was muted by %s", u.Username, m.user.Username), reason))
+	return nil
+}
+
+// lift ends the user's ban or mute early.
+func (m moderator) lift(username, kind string) error {
+	u, err := m.target(username)
+	if err != nil {
+		return err
+	}
+
+	removed, err := store.RemoveSanction(m.room.ID, u.ID, kind)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return errNotSanctioned
+	}
+
+	if kind == sanctionBan {
+		m.record(ModerationEntry{Action: actionUnban, TargetID: &u.ID})
+		return nil
+	}
+	m.record(ModerationEntry{Action: actionUnmute, TargetID: &u.ID})
+	broadcastSystem(m.room.ID, fmt.Sprintf("%s was unmuted by %s", u.Username, m.user.Username))
+	return nil
+}
+
+// pin pins a live message of the room.
+func (m moderator) pin(messageID uint) error {
+	msg, err := m.roomMessage(messageID)
+	if err != nil {
+		return err
+	}
+	if msg.DeletedAt != nil {
+		return errMessageDeleted
+	}
+
+	added, err := store.PinMessage(&RoomPin{RoomID: m.room.ID, MessageID: msg.ID, PinnedBy: m.user.ID, PinnedAt: time.Now()})
+	if err != nil || !added {
+		return err
+	}
+
+	m.record(ModerationEntry{Action: actionPin, MessageID: &msg.ID})
+	broadcastSystem(m.room.ID, m.user.Username+" pinned a message")
+	return nil
+}
+
+func (m moderator) unpin(messageID uint) error {
+	removed, err := store.UnpinMessage(m.room.ID, messageID)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return errMessageNotPinned
+	}
+
+	m.record(ModerationEntry{Action: actionUnpin, MessageID: &messageID})
+	return nil
+}
+
+func (m moderator) roomMessage(messageID uint) (Message, error) {
+	msg, err := store.Message(messageID)
+	if errors.Is(err, errNotFound) {
+		return msg, errMessageNotFound
+	}
+	if err != nil {
+		return msg, err
+	}
+	if msg.RoomID == nil || *msg.RoomID != m.room.ID {
+		return msg, errNotInThisRoom
+	}
+	return msg, nil
+}
+
+// messageModerator checks that userID may delete someone else's message:
+// it must be in a room where they moderate its sender.
+func messageModerator(userID uint, msg Message) (*moderator, error) {
+	if msg.RoomID == nil {
+		return nil, errNotMessageOwner
+	}
+	room, err := store.Room(*msg.RoomID)
+	if err != nil {
+		return nil, errNotMessageOwner
+	}
+	user, err := store.UserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := moderatorOf(room, user)
+	if err != nil || !m.outranks(msg.SenderID) {
+		return nil, errNotMessageOwner
+	}
+	if msg.DeletedAt != nil {
+		return nil, errMessageDeleted
+	}
+	return &m, nil
+}
+
+func sanctionEnd(duration int) *time.Time {
+	if duration == 0 {
+		return nil
+	}
+	end := time.Now().Add(time.Duration(duration) * time.Second)
+	return &end
+}
+
+func withReason(notice, reason string) string {
+	if reason == "" {
+		return notice
+	}
+	return notice + ": " + reason
+}
+
+// ================= MODERATION HANDLERS =================
+
+func httpModerationError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errNotModerator):
+		http.Error(w, "Only the room's moderators can do that", http.StatusForbidden)
+	case errors.Is(err, errNotOwner):
+		http.Error(w, "Only the room's owner can do that", http.StatusForbidden)
+	case errors.Is(err, errOutranked):
+		http.Error(w, "You can only moderate members below your role", http.StatusForbidden)
+	case errors.Is(err, errUnknownUser):
+		http.Error(w, "User not found", http.StatusNotFound)
+	case errors.Is(err, errNotInRoom):
+		http.Error(w, "User is not a member of this room", http.StatusNotFound)
+	case errors.Is(err, errNotSanctioned):
+		http.Error(w, "User is not banned or muted", http.StatusNotFound)
+	case errors.Is(err, errMessageNotFound), errors.Is(err, errNotInThisRoom):
+		http.Error(w, "Message not found", http.StatusNotFound)
+	case errors.Is(err, errMessageNotPinned):
+		http.Error(w, "Message is not pinned", http.StatusNotFound)
+	case errors.Is(err, errMessageDeleted):
+		http.Error(w, "Message was deleted", http.StatusGone)
+	case errors.Is(err, errInvalidRole):
+		http.Error(w, "role must be moderator or member", http.StatusBadRequest)
+	case errors.Is(err, errInvalidDuration):
+		http.Error(w, fmt.Sprintf("duration must be between 0 and %d seconds", maxSanctionDuration), http.StatusBadRequest)
+	case errors.Is(err, errReasonTooLong):
+		http.Error(w, fmt.Sprintf("reason is limited to %d characters", maxReasonLength), http.StatusBadRequest)
+	default:
+		http.Error(w, "Could not moderate room", http.StatusInternalServerError)
+	}
+}
+
+// moderatorFromPath loads the room named by the {id} path segment and
+// checks that user moderates it, writing an error response if not.
+func moderatorFromPath(w http.ResponseWriter, r *http.Request, user User) (moderator, bool) {
+	room, ok := roomFromPath(w, r)
+	if !ok {
+		return moderator{}, false
+	}
+
+	m, err := moderatorOf(room, user)
+	if err != nil {
+		httpModerationError(w, err)
+		return m, false
+	}
+	return m, true
+}
+
+// sanctionRequest is the body of a kick, ban or mute.
+type sanctionRequest struct {
+	User     string `json:"user"`
+	Reason   string `json:"reason"`
+	Duration int    `json:"duration"` // seconds; 0 lasts until lifted
+}
+
+func decodeSanction(w http.ResponseWriter, r *http.Request) (sanctionRequest, bool) {
+	var req sanctionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return req, false
+	}
+
+	req.Reason = strings.TrimSpace(req.Reason)
+	switch {
+	case req.User == "":
+		http.Error(w, "user required", http.StatusBadRequest)
+		return req, false
+	case utf8.RuneCountInString(req.Reason) > maxReasonLength:
+		httpModerationError(w, errReasonTooLong)
+		return req, false
+	case req.Duration < 0 || req.Duration > maxSanctionDuration:
+		httpModerationError(w, errInvalidDuration)
+		return req, false
+	}
+	return req, true
+}
+
+type memberView struct {
+	User     string    `json:"user"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// roomMembersHandler lists a room's members and their roles to its members.
+func roomMembersHandler(w http.ResponseWriter, r *http.Request, user User) {
+	room, ok := roomFromPath(w, r)
+	if !ok {
+		return
+	}
+	if !isRoomMember(room.ID, user.ID) {
+		http.Error(w, "Not a member of this room", http.StatusForbidden)
+		return
+	}
+
+	members, err := store.RoomMembers(room.ID)
+	if err != nil {
+		http.Error(w, "Could not load members", http.StatusInternalServerError)
+		return
+	}
+
+	ids := make([]uint, 0, len(members))
+	for _, m := range members {
+		ids = append(ids, m.UserID)
+	}
+	names := usernamesByID(ids)
+	list := make([]memberView, 0, len(members))
+	for _, m := range members {
+		role := m.Role
+		if m.UserID == room.CreatedBy {
+			role = roleOwner
+		}
+		list = append(list, memberView{User: names[m.UserID], Role: role, JoinedAt: m.JoinedAt})
+	}
+
+	json.NewEncoder(w).Encode(list)
+}
+
+// setRoleHandler serves PUT /rooms/{id}/members/{user}/role.
+func setRoleHandler(w http.ResponseWriter, r *http.Request, user User) {
+	m, ok := moderatorFromPath(w, r, user)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := m.setRole(r.PathValue("user"), req.Role); err != nil {
+		httpModerationError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func kickHandler(w http.ResponseWriter, r *http.Request, user User) {
+	m, ok := moderatorFromPath(w, r, user)
+	if !ok {
+		return
+	}
+	req, ok := decodeSanction(w, r)
+	if !ok {
+		return
+	}
+
+	if err := m.kick(req.User, req.Reason); err != nil {
+		httpModerationError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func banHandler(w http.ResponseWriter, r *http.Request, user User) {
+	m, ok := moderatorFromPath(w, r, user)
+	if !ok {
+		return
+	}
+	req, ok := decodeSanction(w, r)
+	if !ok {
+		return
+	}
+
+	if err := m.ban(req.User, req.Reason, req.Duration); err != nil {
+		httpModerationError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func muteHandler(w http.ResponseWriter, r *http.Request, user User) {
+	m, ok := moderatorFromPath(w, r, user)
+	if !ok {
+		return
+	}
+	req, ok := decodeSanction(w, r)
+	if !ok {
+		return
+	}
+
+	if err := m.mute(req.User, req.Reason, req.Duration); err != nil {
+		httpModerationError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// liftSanctionHandler serves DELETE /rooms/{id}/bans/{user} and
+// /rooms/{id}/mutes/{user}.
+func liftSanctionHandler(kind string) func(http.ResponseWriter, *http.Request, User) {
+	return func(w http.ResponseWriter, r *http.Request, user User) {
+		m, ok := moderatorFromPath(w, r, user)
+		if !ok {
+			return
+		}
+
+		if err := m.lift(r.PathValue("user"), kind); err != nil {
+			httpModerationError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// pinsHandler lists a room's pinned messages, in pinning order, to its
+// members.
+func pinsHandler(w http.ResponseWriter, r *http.Request, user User) {
+	room, ok := roomFromPath(w, r)
+	if !ok {
+		return
+	}
+	if !isRoomMember(room.ID, user.ID) {
+		http.Error(w, "Not a member of this room", http.StatusForbidden)
+		return
+	}
+
+	pins, err := store.RoomPins(room.ID)
+	if err != nil {
+		http.Error(w, "Could not load pins", http.StatusInternalServerError)
+		return
+	}
+
+	ids := make([]uint, 0, len(pins))
+	for _, p := range pins {
+		ids = append(ids, p.MessageID)
+	}
+	msgs, _ := store.MessagesByID(ids)
+	views := make(map[uint]messageView, len(msgs))
+	for _, v := range toMessageViews(user.ID, msgs) {
+		views[v.ID] = v
+	}
+
+	list := make([]messageView, 0, len(pins))
+	for _, p := range pins {
+		if v, ok := views[p.MessageID]; ok {
+			list = append(list, v)
+		}
+	}
+
+	json.NewEncoder(w).Encode(list)
+}
+
+func pinHandler(w http.ResponseWriter, r *http.Request, user User) {
+	m, ok := moderatorFromPath(w, r, user)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		MessageID uint `json:"message_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := m.pin(req.MessageID); err != nil {
+		httpModerationError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// unpinHandler serves DELETE /rooms/{id}/pins/{message}.
+func unpinHandler(w http.ResponseWriter, r *http.Request, user User) {
+	m, ok := moderatorFromPath(w, r, user)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.ParseUint(r.PathValue("message"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid message id", http.StatusBadRequest)
+		return
+	}
+
+	if err := m.unpin(uint(id)); err != nil {
+		httpModerationError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type moderationEntryView struct {
+	ID        uint       `json:"id"`
+	Action    string     `json:"action"`
+	Actor     string     `json:"actor"`
+	Target    string     `json:"target,omitempty"`
+	MessageID uint       `json:"message_id,omitempty"`
+	Detail    string     `json:"detail,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// moderationLogHandler serves GET /rooms/{id}/audit?before=&limit=, newest
+// first, to the room's moderators. before is the ID of the oldest entry
+// already seen.
+func moderationLogHandler(w http.ResponseWriter, r *http.Request, user User) {
+	m, ok := moderatorFromPath(w, r, user)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	limit := moderationLogDefaultLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, historyMaxLimit)
+	}
+	var before uint64
+	if v := query.Get("before"); v != "" {
+		var err error
+		if before, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, "Invalid before", http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, err := store.ModerationLog(m.room.ID, uint(before), limit+1)
+	if err != nil {
+		http.Error(w, "Could not load moderation log", http.StatusInternalServerError)
+		return
+	}
+
+	resp := struct {
+		Entries    []moderationEntryView `json:"entries"`
+		NextBefore uint                  `json:"next_before,omitempty"`
+	}{
+		Entries: make([]moderationEntryView, 0, len(entries)),
+	}
+	if len(entries) > limit {
+		entries = entries[:limit]
+		resp.NextBefore = entries[limit-1].ID
+	}
+
+	var userIDs []uint
+	for _, e := range entries {
+		userIDs = append(userIDs, e.ActorID)
+		if e.TargetID != nil {
+			userIDs = append(userIDs, *e.TargetID)
+		}
+	}
+	names := usernamesByID(userIDs)
+
+	for _, e := range entries {
+		view := moderationEntryView{
+			ID:        e.ID,
+			Action:    e.Action,
+			Actor:     names[e.ActorID],
+			MessageID: derefID(e.MessageID),
+			Detail:    e.Detail,
+			Reason:    e.Reason,
+			ExpiresAt: e.ExpiresAt,
+			CreatedAt: e.CreatedAt,
+		}
+		if e.TargetID != nil {
+			view.Target = names[*e.TargetID]
+		}
+		resp.Entries = append(resp.Entries, view)
+	}
+
+	json.NewEncoder(w).Encode(resp)
+}
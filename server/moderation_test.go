@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoomModeration(t *testing.T) {
+	resetStore(t)
+	_, aliceTokens := register(t, "alice")
+	bob, bobTokens := register(t, "bob")
+	carol, carolTokens := register(t, "carol")
+
+	rec := do(t, "POST", "/rooms", aliceTokens.Token, map[string]string{"name": "general"})
+	var room Room
+	decode(t, rec, &room)
+	path := fmt.Sprintf("/rooms/%d", room.ID)
+	for _, token := range []string{bobTokens.Token, carolTokens.Token} {
+		if rec := do(t, "POST", path+"/join", token, nil); rec.Code != http.StatusNoContent {
+			t.Fatalf("join status = %d", rec.Code)
+		}
+	}
+
+	post := func(sender User) *Message {
+		c := newClient(nil)
+		c.UserID, c.Username = sender.ID, sender.Username
+		return handleRoomMessage(c, room.ID, Message{SenderID: sender.ID, Content: "hi", Timestamp: time.Now()})
+	}
+
+	t.Run("roles", func(t *testing.T) {
+		if rec := do(t, "POST", path+"/kick", bobTokens.Token, sanctionRequest{User: "carol"}); rec.Code != http.StatusForbidden {
+			t.Errorf("kick by member status = %d, want 403", rec.Code)
+		}
+		if rec := do(t, "PUT", path+"/members/bob/role", aliceTokens.Token, map[string]string{"role": "owner"}); rec.Code != http.StatusBadRequest {
+			t.Errorf("make owner status = %d, want 400", rec.Code)
+		}
+		if rec := do(t, "PUT", path+"/members/bob/role", aliceTokens.Token, map[string]string{"role": roleModerator}); rec.Code != http.StatusNoContent {
+			t.Fatalf("make moderator status = %d: %s", rec.Code, rec.Body.String())
+		}
+
+		var members []memberView
+		decode(t, do(t, "GET", path+"/members", carolTokens.Token, nil), &members)
+		roles := make(map[string]string)
+		for _, m := range members {
+			roles[m.User] = m.Role
+		}
+		want := map[string]string{"alice": roleOwner, "bob": roleModerator, "carol": roleMember}
+		if fmt.Sprint(roles) != fmt.Sprint(want) {
+			t.Errorf("roles = %v, want %v", roles, want)
+		}
+
+		// Moderators can't act on the owner or give out roles.
+		if rec := do(t, "POST", path+"/mutes", bobTokens.Token, sanctionRequest{User: "alice"}); rec.Code != http.StatusForbidden {
+			t.Errorf("mute owner status = %d, want 403", rec.Code)
+		}
+		if rec := do(t, "PUT", path+"/members/carol/role", bobTokens.Token, map[string]string{"role": roleModerator}); rec.Code != http.StatusForbidden {
+			t.Errorf("role set by moderator status = %d, want 403", rec.Code)
+		}
+	})
+
+	t.Run("mute", func(t *testing.T) {
+		earlier := post(carol)
+		rec := do(t, "POST", path+"/mutes", bobTokens.Token, sanctionRequest{User: "carol", Reason: "spam", Duration: 60})
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("mute status = %d: %s", rec.Code, rec.Body.String())
+		}
+		if post(carol) != nil {
+			t.Error("muted member could post")
+		}
+		if _, err := editMessage(carol.ID, earlier.ID, "edited while muted"); err != errMutedInRoom {
+			t.Errorf("editMessage() while muted error = %v, want errMutedInRoom", err)
+		}
+		if post(bob) == nil {
+			t.Error("moderator could not post")
+		}
+
+		if rec := do(t, "DELETE", path+"/mutes/carol", bobTokens.Token, nil); rec.Code != http.StatusNoContent {
+			t.Fatalf("unmute status = %d", rec.Code)
+		}
+		if post(carol) == nil {
+			t.Error("unmuted member could not post")
+		}
+		if rec := do(t, "DELETE", path+"/mutes/carol", bobTokens.Token, nil); rec.Code != http.StatusNotFound {
+			t.Errorf("second unmute status = %d, want 404", rec.Code)
+		}
+	})
+
+	t.Run("delete and pin", func(t *testing.T) {
+		msg := post(carol)
+		if msg == nil {
+			t.Fatal("member could not post")
+		}
+		if rec := do(t, "POST", path+"/pins", bobTokens.Token, map[string]uint{"message_id": msg.ID}); rec.Code != http.StatusNoContent {
+			t.Fatalf("pin status = %d: %s", rec.Code, rec.Body.String())
+		}
+		var pins []messageView
+		decode(t, do(t, "GET", path+"/pins", carolTokens.Token, nil), &pins)
+		if len(pins) != 1 || pins[0].ID != msg.ID {
+			t.Errorf("pins = %+v, want message %d", pins, msg.ID)
+		}
+
+		// Members can't delete each other's messages; moderators can.
+		own := post(bob)
+		if _, err := deleteMessage(carol.ID, own.ID); err != errNotMessageOwner {
+			t.Errorf("deleteMessage() by member error = %v, want errNotMessageOwner", err)
+		}
+		if rec := do(t, "DELETE", fmt.Sprintf("/messages/%d", msg.ID), bobTokens.Token, nil); rec.Code != http.StatusNoContent {
+			t.Fatalf("moderator delete status = %d: %s", rec.Code, rec.Body.String())
+		}
+		if pins, _ := store.RoomPins(room.ID); len(pins) != 0 {
+			t.Errorf("pins after delete = %+v, want none", pins)
+		}
+	})
+
+	t.Run("kick and ban", func(t *testing.T) {
+		kept := post(carol)
+		if rec := do(t, "POST", path+"/kick", bobTokens.Token, sanctionRequest{User: "carol"}); rec.Code != http.StatusNoContent {
+			t.Fatalf("kick status = %d: %s", rec.Code, rec.Body.String())
+		}
+		if isRoomMember(room.ID, carol.ID) {
+			t.Error("kicked member is still in the room")
+		}
+		if rec := do(t, "PATCH", fmt.Sprintf("/messages/%d", kept.ID), carolTokens.Token, map[string]string{"content": "edited after kick"}); rec.Code != http.StatusForbidden {
+			t.Errorf("edit after kick status = %d, want 403", rec.Code)
+		}
+		if rec := do(t, "POST", path+"/join", carolTokens.Token, nil); rec.Code != http.StatusNoContent {
+			t.Fatalf("rejoin after kick status = %d", rec.Code)
+		}
+
+		if rec := do(t, "POST", path+"/bans", bobTokens.Token, sanctionRequest{User: "carol", Duration: -1}); rec.Code != http.StatusBadRequest {
+			t.Errorf("negative ban status = %d, want 400", rec.Code)
+		}
+		if rec := do(t, "POST", path+"/bans", bobTokens.Token, sanctionRequest{User: "carol", Reason: "again"}); rec.Code != http.StatusNoContent {
+			t.Fatalf("ban status = %d: %s", rec.Code, rec.Body.String())
+		}
+		if rec := do(t, "POST", path+"/join", carolTokens.Token, nil); rec.Code != http.StatusForbidden {
+			t.Errorf("rejoin after ban status = %d, want 403", rec.Code)
+		}
+		if rec := do(t, "DELETE", path+"/bans/carol", bobTokens.Token, nil); rec.Code != http.StatusNoContent {
+			t.Fatalf("unban status = %d", rec.Code)
+		}
+		if rec := do(t, "POST", path+"/join", carolTokens.Token, nil); rec.Code != http.StatusNoContent {
+			t.Errorf("rejoin after unban status = %d", rec.Code)
+		}
+	})
+
+	t.Run("audit log", func(t *testing.T) {
+		if rec := do(t, "GET", path+"/audit", carolTokens.Token, nil); rec.Code != http.StatusForbidden {
+			t.Errorf("audit log as member status = %d, want 403", rec.Code)
+		}
+
+		var page struct {
+			Entries    []moderationEntryView `json:"entries"`
+			NextBefore uint                  `json:"next_before"`
+		}
+		decode(t, do(t, "GET", path+"/audit?limit=3", aliceTokens.Token, nil), &page)
+
+		var actions []string
+		for _, e := range page.Entries {
+			actions = append(actions, e.Action)
+		}
+		want := []string{actionUnban, actionBan, actionKick}
+		if fmt.Sprint(actions) != fmt.Sprint(want) {
+			t.Fatalf("latest actions = %v, want %v", actions, want)
+		}
+		if e := page.Entries[1]; e.Actor != "bob" || e.Target != "carol" || e.Reason != "again" {
+			t.Errorf("ban entry = %+v", e)
+		}
+
+		decode(t, do(t, "GET", fmt.Sprintf("%s/audit?before=%d", path, page.NextBefore), aliceTokens.Token, nil), &page)
+		actions = actions[:0]
+		for _, e := range page.Entries {
+			actions = append(actions, e.Action)
+		}
+		want = []string{actionDelete, actionPin, actionUnmute, actionMute, actionSetRole}
+		if fmt.Sprint(actions) != fmt.Sprint(want) {
+			t.Errorf("older actions = %v, want %v", actions, want)
+		}
+	})
+}
+
+func TestRoomAudienceFollowsMembership(t *testing.T) {
+	resetStore(t)
+	alice, aliceTokens := register(t, "alice")
+	bob, bobTokens := register(t, "bob")
+	carol, carolTokens := register(t, "carol")
+
+	rec := do(t, "POST", "/rooms", aliceTokens.Token, map[string]string{"name": "general"})
+	var room Room
+	decode(t, rec, &room)
+	path := fmt.Sprintf("/rooms/%d", room.ID)
+	do(t, "POST", path+"/join", bobTokens.Token, nil)
+
+	sender := newClient(nil)
+	sender.UserID, sender.Username = alice.ID, alice.Username
+	parent := handleRoomMessage(sender, room.ID, Message{SenderID: alice.ID, Content: "hi", Timestamp: time.Now()})
+
+	// bob saw the first message but is banned; carol joins afterwards.
+	if rec := do(t, "POST", path+"/bans", aliceTokens.Token, sanctionRequest{User: "bob"}); rec.Code != http.StatusNoContent {
+		t.Fatalf("ban status = %d", rec.Code)
+	}
+	do(t, "POST", path+"/join", carolTokens.Token, nil)
+
+	bobClient, carolClient := fakeClient(bob.ID, "bob"), fakeClient(carol.ID, "carol")
+	for _, c := range []*Client{bobClient, carolClient} {
+		hub.register <- c
+		t.Cleanup(func() { hub.unregister <- c })
+	}
+
+	reply := Message{SenderID: alice.ID, ParentID: &parent.ID, Content: "secret after ban", Timestamp: time.Now()}
+	handleRoomMessage(sender, room.ID, reply)
+	pushThreadUpdate(parent.ID)
+
+	// threadUpdated reports whether c is sent the thread's update.
+	threadUpdated := func(c *Client) bool {
+		for {
+			select {
+			case frame := <-c.send:
+				if strings.Contains(string(frame), `"type":"thread_updated"`) {
+					return true
+				}
+			case <-time.After(500 * time.Millisecond):
+				return false
+			}
+		}
+	}
+	if !threadUpdated(carolClient) {
+		t.Error("member who joined later got no thread update")
+	}
+	if threadUpdated(bobClient) {
+		t.Error("banned user got a thread update")
+	}
+}
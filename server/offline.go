@@ -0,0 +1,97 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	// Messages sent per "missed" frame while flushing the offline queue.
+	offlineBatchSize = 100
+
+	maxDeviceIDLength = 64
+)
+
+// DeviceCursor remembers, per user and device, the newest queued message the
+// device has confirmed. Every message addressed to a user has a
+// MessageReceipt row, so the receipts after the cursor are exactly what that
+// device missed while it was offline.
+type DeviceCursor struct {
+	UserID        uint   `gorm:"primaryKey"`
+	Device        string `gorm:"primaryKey;size:64"`
+	LastMessageID uint
+	UpdatedAt     time.Time
+}
+
+// loadDeviceCursor returns the cursor of a known device. ok is false for a
+// device that has never connected before.
+func loadDeviceCursor(userID uint, device string) (cursor DeviceCursor, ok bool) {
+	cursor, err := store.DeviceCursor(userID, device)
+	return cursor, err == nil
+}
+
+// flushOffline queues, oldest first, every message addressed to the client's
+// user after the device cursor, and returns the newest ID sent. Like
+// replayHistory it must run before the client is registered with the hub.
+func flushOffline(client *Client, afterID uint) uint {
+	for {
+		ids, _ := store.ReceiptsAfter(client.UserID, afterID, offlineBatchSize)
+		if len(ids) == 0 {
+			return afterID
+		}
+
+		msgs, _ := store.MessagesByID(ids)
+
+		if !client.queue(missedEvent{Messages: toMessageViews(client.UserID, msgs)}) {
+			return afterID
+		}
+
+		afterID = ids[len(ids)-1]
+		if len(ids) < offlineBatchSize {
+			return afterID
+		}
+	}
+}
+
+// catchUpOffline sends queued messages stored between the pre-registration
+// flush and registration. They go through the hub, so a message may also
+// arrive live; clients drop duplicates by ID.
+func catchUpOffline(client *Client, afterID uint) {
+	ids, _ := store.ReceiptsAfter(client.UserID, afterID, 0)
+	if len(ids) == 0 {
+		return
+	}
+
+	msgs, _ := store.MessagesByID(ids)
+
+	hub.sendTo(client, missedEvent{Messages: toMessageViews(client.UserID, msgs)})
+}
+
+// latestReceiptID is the newest message addressed to userID, used as the
+// starting cursor of a new device that was given the regular history replay.
+func latestReceiptID(userID uint) uint {
+	id, _ := store.LatestReceiptID(userID)
+	return id
+}
+
+// advanceDeviceCursor moves the device cursor forward across the queued
+// messages it has acknowledged in messageIDs, up to the first it hasn't.
+// Cursors only ever move forward, so a device never receives the same
+// acknowledged message on two reconnects, and a gap left by an ack that
+// went missing or arrived out of order is flushed again.
+func advanceDeviceCursor(userID uint, device string, messageIDs []uint) {
+	if device == "" || len(messageIDs) == 0 {
+		return
+	}
+
+	store.AdvanceDeviceCursor(userID, device, messageIDs, time.Now())
+}
+
+// startDevice creates the cursor of a device seen for the first time.
+func startDevice(userID uint, device string, lastMessageID uint) {
+	store.StartDevice(DeviceCursor{
+		UserID:        userID,
+		Device:        device,
+		LastMessageID: lastMessageID,
+		UpdatedAt:     time.Now(),
+	})
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Long polling is the fallback for clients behind proxies that buffer
+// Server-Sent Events as well as breaking websockets. GET /poll opens a
+// session and answers with its "session" event; the client then keeps a
+// GET /poll?session=<id>&after=<next> outstanding to collect the envelopes
+// a chat.v1 websocket would receive, and sends its frames with
+// POST /events?session=<id> as an event stream client does.
+
+const (
+	// How long a poll waits for a frame before answering with none.
+	// Proxies commonly time requests out after 30 seconds.
+	pollWait = 25 * time.Second
+
+	// A session ends when no poll arrives for this long.
+	pollIdleTimeout = pongWait
+)
+
+// pollBatch answers a poll with the frames after its sequence number.
+type pollBatch struct {
+	Events []json.RawMessage `json:"events"`
+	Next   uint64            `json:"next"` // the after of the next poll
+}
+
+// pollRequest is a poll waiting on a session's writer.
+type pollRequest struct {
+	after uint64
+	reply chan pollBatch
+}
+
+func pollHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("session") == "" {
+		openPoll(w, r)
+		return
+	}
+
+	_, user, err := authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	after, err := strconv.ParseUint(query.Get("after"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid after", http.StatusBadRequest)
+		return
+	}
+
+	streams.Lock()
+	client := streams.byID[query.Get("session")]
+	streams.Unlock()
+	if client == nil || client.UserID != user.ID || client.stream.polls == nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	collectPoll(w, r, client, after)
+}
+
+// openPoll starts a long-polling session and answers the poll that opened
+// it. The session outlives the request, so it holds its own slot in conns.
+func openPoll(w http.ResponseWriter, r *http.Request) {
+	if !conns.enter() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	client := openStream(w, r)
+	if client == nil {
+		conns.leave()
+		return
+	}
+	client.stream.polls = make(chan pollRequest)
+	addStream(client)
+
+	go func() {
+		defer conns.leave()
+		defer removeStream(client)
+		pollEvents(client)
+
+		// Let setup stop queuing, then wait for it to register the session.
+		close(client.stopped)
+		<-client.stream.ready
+		endSession(client)
+	}()
+
+	go func() {
+		client.queue(sessionEvent{Session: client.stream.id})
+		startSession(client)
+		close(client.stream.ready)
+	}()
+
+	collectPoll(w, r, client, 0)
+}
+
+// collectPoll hands the poll to the session's writer and writes its batch.
+func collectPoll(w http.ResponseWriter, r *http.Request, client *Client, after uint64) {
+	req := pollRequest{after: after, reply: make(chan pollBatch, 1)}
+	select {
+	case client.stream.polls <- req:
+	case <-client.stopped:
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	case <-r.Context().Done():
+		return
+	}
+
+	var batch pollBatch
+	select {
+	case batch = <-req.reply:
+	case <-client.stopped:
+		// The writer may have answered just before it exited.
+		select {
+		case batch = <-req.reply:
+		default:
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+	case <-r.Context().Done():
+		// The batch stays queued until a poll confirms it arrived.
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(batch)
+}
+
+// pollEvents is the writer of a long-polling client. It holds the frames the
+// hub sends until a poll collects them, and keeps each batch until a poll
+// with a later after confirms it arrived, so a response lost on the way is
+// sent again. It returns once the client stops polling, or once the final
+// frames have been collected after the hub drops the client or the session
+// is stopped.
+func pollEvents(client *Client) {
+	s := client.stream
+	timer := time.NewTimer(pollIdleTimeout)
+	defer timer.Stop()
+
+	var (
+		pending [][]byte
+		first   uint64 = 1 // sequence number of pending[0]
+		parked  *pollRequest
+		ending  bool
+	)
+	send, done := client.send, s.done
+
+	for {
+		// Stop taking frames while a buffer's worth is waiting; the hub
+		// then drops the client like any other that can't keep up.
+		in := send
+		if len(pending) >= sendBufferSize {
+			in = nil
+		}
+
+		select {
+		case frame, ok := <-in:
+			if !ok {
+				send, ending = nil, true
+				timer.Reset(writeWait)
+				break
+			}
+			pending = append(pending, frame)
+
+		case <-done:
+			pending = append(pending, encodeEvent(s.closing).envelope)
+			done, ending = nil, true
+			timer.Reset(writeWait)
+
+		case req := <-s.polls:
+			// The frames up to after have arrived.
+			if req.after >= first {
+				n := min(req.after-first+1, uint64(len(pending)))
+				pending = pending[n:]
+				first += n
+			}
+			if parked != nil {
+				parked.reply <- pollBatch{Events: []json.RawMessage{}, Next: first - 1}
+			}
+			parked = &req
+			if !ending {
+				timer.Reset(pollWait)
+			}
+
+		case <-timer.C:
+			if parked == nil {
+				return
+			}
+			parked.reply <- pollBatch{Events: []json.RawMessage{}, Next: first - 1}
+			parked = nil
+			if ending {
+				return
+			}
+			timer.Reset(pollIdleTimeout)
+		}
+
+		if parked != nil && (len(pending) > 0 || ending) {
+			events := make([]json.RawMessage, len(pending))
+			for i, frame := range pending {
+				events[i] = frame
+			}
+			parked.reply <- pollBatch{Events: events, Next: first + uint64(len(pending)) - 1}
+			parked = nil
+			if ending {
+				return
+			}
+			timer.Reset(pollIdleTimeout)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLongPoll(t *testing.T) {
+	resetStore(t)
+	srv := httptest.NewServer(routes())
+	defer srv.Close()
+	_, alice := register(t, "alice")
+	_, bob := register(t, "bob")
+
+	poll := func(token, query string) (int, pollBatch) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/poll?"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET /poll error = %v", err)
+		}
+		defer res.Body.Close()
+
+		var batch pollBatch
+		if res.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(res.Body).Decode(&batch); err != nil {
+				t.Fatalf("decoding poll: %v", err)
+			}
+		}
+		return res.StatusCode, batch
+	}
+	types := func(batch pollBatch) []string {
+		t.Helper()
+		var list []string
+		for _, data := range batch.Events {
+			var env envelope
+			if err := decodeStrict(data, &env); err != nil {
+				t.Fatalf("event %s is not an envelope: %v", data, err)
+			}
+			list = append(list, env.Type)
+		}
+		return list
+	}
+
+	code, batch := poll(alice.Token, "device=d1")
+	if code != http.StatusOK || len(batch.Events) == 0 {
+		t.Fatalf("opening poll = %d, %+v", code, batch)
+	}
+	var env envelope
+	var session sessionEvent
+	decodeStrict(batch.Events[0], &env)
+	if err := json.Unmarshal(env.Payload, &session); err != nil || env.Type != "session" || session.Session == "" {
+		t.Fatalf("first event = %s, want a session", batch.Events[0])
+	}
+	query := func(after uint64) string {
+		return fmt.Sprintf("session=%s&after=%d", session.Session, after)
+	}
+
+	payload, _ := json.Marshal(sendMessageEvent{ClientID: "c1", Content: "hello"})
+	frame, _ := json.Marshal(envelope{Type: "message", ID: "f1", TS: time.Now(), Payload: payload})
+	req, _ := http.NewRequest("POST", srv.URL+"/events?session="+session.Session, bytes.NewReader(frame))
+	req.Header.Set("Authorization", "Bearer "+alice.Token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST /events error = %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("POST /events status = %d, want 202", res.StatusCode)
+	}
+
+	// Each poll confirms the batches before it.
+	after, acked := batch.Next, false
+	for polls := 0; !acked; polls++ {
+		if polls > 10 {
+			t.Fatal("no ack after 10 polls")
+		}
+		code, batch = poll(alice.Token, query(after))
+		if code != http.StatusOK {
+			t.Fatalf("poll status = %d", code)
+		}
+		for _, typ := range types(batch) {
+			acked = acked || typ == "ack"
+		}
+		if !acked {
+			after = batch.Next
+		}
+	}
+
+	t.Run("lost response", func(t *testing.T) {
+		_, again := poll(alice.Token, query(after))
+		if fmt.Sprint(types(again)) != fmt.Sprint(types(batch)) || again.Next != batch.Next {
+			t.Errorf("repeated poll = %v up to %d, want %v up to %d", types(again), again.Next, types(batch), batch.Next)
+		}
+	})
+
+	t.Run("foreign session", func(t *testing.T) {
+		if code, _ := poll(bob.Token, query(batch.Next)); code != http.StatusNotFound {
+			t.Errorf("poll as another user status = %d, want 404", code)
+		}
+	})
+
+	t.Run("bad after", func(t *testing.T) {
+		if code, _ := poll(alice.Token, "session="+session.Session+"&after=x"); code != http.StatusBadRequest {
+			t.Errorf("poll status = %d, want 400", code)
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		streams.Lock()
+		client := streams.byID[session.Session]
+		streams.Unlock()
+		client.disconnect("token revoked")
+
+		// Frames already queued may come first.
+		last := batch
+		for closed := false; !closed; {
+			code, next := poll(alice.Token, query(last.Next))
+			if code != http.StatusOK {
+				t.Fatalf("poll status = %d before the close event", code)
+			}
+			got := types(next)
+			closed = len(got) > 0 && got[len(got)-1] == "close"
+			last = next
+		}
+		if code, _ := poll(alice.Token, query(last.Next)); code != http.StatusNotFound {
+			t.Errorf("poll after close status = %d, want 404", code)
+		}
+	})
+}
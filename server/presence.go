@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	presenceOnline  = "online"
+	presenceAway    = "away"
+	presenceOffline = "offline"
+)
+
+// A typing indicator is dropped if the client doesn't renew it in time.
+const typingTimeout = 5 * time.Second
+
+// presence reports a user's state across all of their connections on every
+// node: online if any connection is active, away if all of them are idle.
+// It runs on the hub goroutine.
+func (h *Hub) presence(userID uint) string {
+	state := h.localPresence(userID)
+	for _, n := range h.remote {
+		if p, ok := n.users[userID]; ok {
+			state = mergePresence(state, p.State)
+		}
+	}
+	return state
+}
+
+// localPresence is the user's state across this node's connections only.
+func (h *Hub) localPresence(userID uint) string {
+	state := presenceOffline
+	for c := range h.sessions[userID] {
+		if !c.away {
+			return presenceOnline
+		}
+		state = presenceAway
+	}
+	return state
+}
+
+// mergePresence returns the more present of two states.
+func mergePresence(a, b string) string {
+	if a == presenceOnline || b == presenceOnline {
+		return presenceOnline
+	}
+	if a == presenceAway || b == presenceAway {
+		return presenceAway
+	}
+	return presenceOffline
+}
+
+// updatePresence applies change, a mutation of this node's sessions of a
+// user, then tells the other nodes if the user's local state changed and
+// announces any change to the overall state. It runs on the hub goroutine.
+func (h *Hub) updatePresence(userID uint, username string, change func()) {
+	before, localBefore := h.presence(userID), h.localPresence(userID)
+	change()
+
+	if local := h.localPresence(userID); local != localBefore {
+		h.publish(busEvent{Kind: busPresence, Presence: []nodePresence{
+			{UserID: userID, Username: username, State: local},
+		}})
+	}
+	h.announcePresence(username, before, h.presence(userID))
+}
+
+// announcePresence tells this node's clients that a user's overall state
+// went from before to after: everyone hears when they join or leave, and
+// their watchers get the new state. Every node announces to its own
+// clients, so it dispatches directly.
+func (h *Hub) announcePresence(username, before, after string) {
+	if after == before {
+		return
+	}
+
+	switch {
+	case before == presenceOffline:
+		h.dispatch(delivery{frame: encodeEvent(systemEvent{Content: username + " joined the chat"})})
+	case after == presenceOffline:
+		h.dispatch(delivery{frame: encodeEvent(systemEvent{Content: username + " left the chat"})})
+	}
+
+	var lastSeen *time.Time
+	if after == presenceOffline {
+		now := time.Now()
+		lastSeen = &now
+	}
+
+	h.dispatch(delivery{
+		frame: encodeEvent(presenceEvent{User: username, Status: after, LastSeen: lastSeen}),
+		match: func(c *Client) bool { return c.watching[username] },
+	})
+}
+
+// handlePresence lets a client mark itself away or back online.
+func handlePresence(client *Client, status string) {
+	if status != presenceOnline && status != presenceAway {
+		sendError(client, "invalid_status", "Status must be online or away")
+		return
+	}
+
+	hub.do(func(map[*Client]bool) {
+		hub.updatePresence(client.UserID, client.Username, func() {
+			client.away = status == presenceAway
+		})
+	})
+}
+
+// handleSubscribe replaces the set of users whose presence the client
+// follows and sends their current state.
+func handleSubscribe(client *Client, usernames []string) {
+	users, _ := store.UsersByName(usernames)
+
+	watching := make(map[string]bool, len(users))
+	for _, u := range users {
+		watching[u.Username] = true
+	}
+
+	states := make(map[string]string, len(users))
+	hub.do(func(map[*Client]bool) {
+		client.watching = watching
+		for _, u := range users {
+			states[u.Username] = hub.presence(u.ID)
+		}
+	})
+
+	for _, u := range users {
+		var lastSeen *time.Time
+		if states[u.Username] == presenceOffline {
+			lastSeen = u.LastSeen
+		}
+		hub.sendTo(client, presenceEvent{User: u.Username, Status: states[u.Username], LastSeen: lastSeen})
+	}
+}
+
+// ================= TYPING =================
+
+type typingKey struct {
+	UserID uint
+	Conv   conversation
+}
+
+type typingState struct {
+	timer *time.Timer
+	relay func(state string)
+}
+
+var (
+	typing   = make(map[typingKey]*typingState)
+	typingMu sync.Mutex
+)
+
+// handleTyping relays a typing indicator to the other side of a conversation.
+// Clients resend it while the user keeps typing; it stops on its own after
+// typingTimeout or as soon as the user sends a message.
+func handleTyping(client *Client, recipient string, roomID uint) {
+	var conv conversation
+	var targets []uint
+
+	switch {
+	case roomID != 0:
+		members := roomMemberIDs(roomID)
+		if !members[client.UserID] {
+			sendError(client, "not_member", "You are not a member of this room")
+			return
+		}
+		conv.RoomID = roomID
+		for id := range members {
+			if id != client.UserID {
+				targets = append(targets, id)
+			}
+		}
+
+	case recipient != "":
+		peer, err := store.UserByName(recipient)
+		if errors.Is(err, errNotFound) {
+			sendError(client, "unknown_recipient", "User "+recipient+" does not exist")
+			return
+		}
+		if err != nil {
+			return
+		}
+		conv.PeerID = peer.ID
+		targets = []uint{peer.ID}
+
+	}
+
+	key := typingKey{UserID: client.UserID, Conv: conv}
+
+	typingMu.Lock()
+	defer typingMu.Unlock()
+
+	if st, ok := typing[key]; ok {
+		st.timer.Reset(typingTimeout)
+		return
+	}
+
+	st := &typingState{
+		relay: func(state string) {
+			frame := typingEvent{User: client.Username, State: state, Room: conv.RoomID}
+			if conv.RoomID == 0 && conv.PeerID == 0 {
+				hub.sendExcept(frame, client.UserID)
+				return
+			}
+			hub.sendToUsers(frame, targets...)
+		},
+	}
+	st.timer = time.AfterFunc(typingTimeout, func() { stopTyping(key.UserID, key.Conv) })
+	typing[key] = st
+
+	st.relay("started")
+}
+
+// stopTyping clears a typing indicator, telling the other side if one was
+// showing.
+func stopTyping(userID uint, conv conversation) {
+	typingMu.Lock()
+	st, ok := typing[typingKey{UserID: userID, Conv: conv}]
+	if ok {
+		st.timer.Stop()
+		delete(typing, typingKey{UserID: userID, Conv: conv})
+	}
+	typingMu.Unlock()
+
+	if ok {
+		st.relay("stopped")
+	}
+}
+
+// stopTypingAll clears every indicator of a user, e.g. when they disconnect.
+func stopTypingAll(userID uint) {
+	typingMu.Lock()
+	var convs []conversation
+	for key := range typing {
+		if key.UserID == userID {
+			convs = append(convs, key.Conv)
+		}
+	}
+	typingMu.Unlock()
+
+	for _, conv := range convs {
+		stopTyping(userID, conv)
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// protocolV1 is the websocket subprotocol of the versioned protocol. A
+// client that asks for it in Sec-WebSocket-Protocol exchanges envelopes in
+// both directions and is held to strict decoding. A client that asks for
+// no subprotocol gets the original flat frames: the same payloads with
+// "type" added alongside their fields.
+const protocolV1 = "chat.v1"
+
+// envelope wraps every frame of the versioned protocol.
+type envelope struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id"` // unique per frame; errors name the frame they answer in ref
+	TS      time.Time       `json:"ts"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+var (
+	errUnknownType    = errors.New("unknown frame type")
+	errInvalidPayload = errors.New("invalid payload")
+)
+
+// ================= SERVER EVENTS =================
+
+// serverEvent is the payload of a frame the server sends.
+type serverEvent interface {
+	eventType() string
+}
+
+// chatMessageEvent is a lobby or room message.
+type chatMessageEvent struct {
+	ID          uint             `json:"id"`
+	Sender      string           `json:"sender"`
+	Room        uint             `json:"room,omitempty"`
+	Content     string           `json:"content"`
+	Timestamp   time.Time        `json:"timestamp"`
+	ParentID    uint             `json:"parent_id,omitempty"`
+	Attachments []attachmentView `json:"attachments,omitempty"`
+}
+
+// directMessageEvent is a private message, sent to both participants.
+type directMessageEvent struct {
+	ID          uint             `json:"id"`
+	Sender      string           `json:"sender"`
+	Recipient   string           `json:"recipient"`
+	Content     string           `json:"content"`
+	Timestamp   time.Time        `json:"timestamp"`
+	ParentID    uint             `json:"parent_id,omitempty"`
+	Attachments []attachmentView `json:"attachments,omitempty"`
+}
+
+// systemEvent is a notice from the server, such as a user joining.
+type systemEvent struct {
+	Content string `json:"content"`
+	Room    uint   `json:"room,omitempty"`
+}
+
+// errorEvent reports a problem with something the client sent. Throttling
+// errors say when the client may try again.
+type errorEvent struct {
+	Code         string     `json:"code"`
+	Content      string     `json:"content"`
+	Ref          string     `json:"ref,omitempty"` // ID of the frame at fault
+	RetryAfterMs *int64     `json:"retry_after_ms,omitempty"`
+	Until        *time.Time `json:"until,omitempty"`
+}
+
+// ackEvent pairs the client's temporary ID for a message with the stored
+// one.
+type ackEvent struct {
+	ClientID  string    `json:"client_id"`
+	ID        uint      `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// historyEvent replays the newest messages of one conversation on connect.
+type historyEvent struct {
+	Messages   []messageView `json:"messages"`
+	Room       uint          `json:"room,omitempty"`
+	With       string        `json:"with,omitempty"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+// missedEvent delivers messages queued while the device was offline.
+type missedEvent struct {
+	Messages []messageView `json:"messages"`
+}
+
+type presenceEvent struct {
+	User     string     `json:"user"`
+	Status   string     `json:"status"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+}
+
+type typingEvent struct {
+	User  string `json:"user"`
+	State string `json:"state"` // started or stopped
+	Room  uint   `json:"room,omitempty"`
+}
+
+// receiptEvent tells a sender that their messages were delivered or read;
+// its type is the receipt state.
+type receiptEvent struct {
+	State      string    `json:"-"`
+	User       string    `json:"user"`
+	MessageIDs []uint    `json:"message_ids"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+type messageUpdatedEvent struct {
+	ID       uint       `json:"id"`
+	Content  string     `json:"content"`
+	EditedAt *time.Time `json:"edited_at"`
+	Room     uint       `json:"room,omitempty"`
+}
+
+type messageDeletedEvent struct {
+	ID        uint       `json:"id"`
+	DeletedAt *time.Time `json:"deleted_at"`
+	Room      uint       `json:"room,omitempty"`
+}
+
+type reactionsEvent struct {
+	ID        uint              `json:"id"`
+	Reactions []reactionSummary `json:"reactions"`
+	Room      uint              `json:"room,omitempty"`
+}
+
+type threadUpdatedEvent struct {
+	ID     uint           `json:"id"`
+	Thread *threadSummary `json:"thread"`
+	Room   uint           `json:"room,omitempty"`
+}
+
+type mentionEvent struct {
+	ID        uint        `json:"id"`
+	Message   messageView `json:"message"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+// sessionEvent opens a Server-Sent Events stream or long-polling session
+// with the ID that frames posted for the session must carry.
+type sessionEvent struct {
+	Session string `json:"session"`
+}
+
+// closeEvent ends a Server-Sent Events stream or long-polling session, with
+// the code and reason a websocket would get in its close frame.
+type closeEvent struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// notificationsReadEvent keeps unread badges in step across devices.
+type notificationsReadEvent struct {
+	IDs         []uint `json:"ids"`
+	UnreadCount int64  `json:"unread_count"`
+}
+
+func (chatMessageEvent) eventType() string       { return "message" }
+func (directMessageEvent) eventType() string     { return "direct" }
+func (systemEvent) eventType() string            { return "system" }
+func (errorEvent) eventType() string             { return "error" }
+func (ackEvent) eventType() string               { return "ack" }
+func (historyEvent) eventType() string           { return "history" }
+func (missedEvent) eventType() string            { return "missed" }
+func (presenceEvent) eventType() string          { return "presence" }
+func (typingEvent) eventType() string            { return "typing" }
+func (e receiptEvent) eventType() string         { return e.State }
+func (messageUpdatedEvent) eventType() string    { return "message_updated" }
+func (messageDeletedEvent) eventType() string    { return "message_deleted" }
+func (reactionsEvent) eventType() string         { return "reactions" }
+func (threadUpdatedEvent) eventType() string     { return "thread_updated" }
+func (mentionEvent) eventType() string           { return "mention" }
+func (notificationsReadEvent) eventType() string { return "notifications_read" }
+func (sessionEvent) eventType() string           { return "session" }
+func (closeEvent) eventType() string             { return "close" }
+
+// serverEvents lists every event the server sends, for the schema.
+var serverEvents = []serverEvent{
+	chatMessageEvent{}, directMessageEvent{}, systemEvent{}, errorEvent{}, ackEvent{},
+	historyEvent{}, missedEvent{}, presenceEvent{}, typingEvent{},
+	receiptEvent{State: receiptDelivered}, receiptEvent{State: receiptRead},
+	messageUpdatedEvent{}, messageDeletedEvent{}, reactionsEvent{}, threadUpdatedEvent{},
+	mentionEvent{}, notificationsReadEvent{}, sessionEvent{}, closeEvent{},
+}
+
+// ================= CLIENT EVENTS =================
+
+// clientEvent is the payload of a frame a client sends after
+// authenticating.
+type clientEvent interface {
+	handle(c *Client)
+}
+
+// authEvent must be the first frame of a connection. device is a stable
+// client-chosen ID used to resume the offline queue.
+type authEvent struct {
+	Token  string `json:"token"`
+	Device string `json:"device,omitempty"`
+}
+
+// sendMessageEvent posts a message to a room, a user or, with neither set,
+// the lobby. Replies set parent_id and go to the thread's conversation.
+type sendMessageEvent struct {
+	ClientID    string `json:"client_id,omitempty"`
+	Content     string `json:"content"`
+	Recipient   string `json:"recipient,omitempty"`
+	Room        uint   `json:"room,omitempty"`
+	ParentID    uint   `json:"parent_id,omitempty"`
+	Attachments []uint `json:"attachments,omitempty"`
+}
+
+// reauthEvent presents a refreshed access token for the open session.
+type reauthEvent struct {
+	Token string `json:"token"`
+}
+
+type startTypingEvent struct {
+	Recipient string `json:"recipient,omitempty"`
+	Room      uint   `json:"room,omitempty"`
+}
+
+type setPresenceEvent struct {
+	Status string `json:"status"` // online or away
+}
+
+// subscribeEvent replaces the set of users whose presence the client
+// follows.
+type subscribeEvent struct {
+	Users []string `json:"users"`
+}
+
+// markReceiptsEvent acknowledges messages as delivered or read; its type
+// is the receipt state.
+type markReceiptsEvent struct {
+	state      string
+	MessageIDs []uint `json:"message_ids"`
+}
+
+type editEvent struct {
+	ID      uint   `json:"id"`
+	Content string `json:"content"`
+}
+
+type deleteEvent struct {
+	ID uint `json:"id"`
+}
+
+// reactEvent adds an emoji to a message, or removes it for "unreact".
+type reactEvent struct {
+	add   bool
+	ID    uint   `json:"id"`
+	Emoji string `json:"emoji"`
+}
+
+func (e *sendMessageEvent) handle(c *Client) { handleChatMessage(c, e) }
+func (e *reauthEvent) handle(c *Client)      { handleReauth(c, e.Token) }
+func (e *startTypingEvent) handle(c *Client) { handleTyping(c, e.Recipient, e.Room) }
+func (e *setPresenceEvent) handle(c *Client) { handlePresence(c, e.Status) }
+func (e *subscribeEvent) handle(c *Client)   { handleSubscribe(c, e.Users) }
+func (e *markReceiptsEvent) handle(c *Client) {
+	handleReceipt(c, e.state, e.MessageIDs)
+}
+func (e *reactEvent) handle(c *Client) { handleReaction(c, e.ID, e.Emoji, e.add) }
+
+func (e *editEvent) handle(c *Client) {
+	if _, err := editMessage(c.UserID, e.ID, e.Content); err != nil {
+		sendEditError(c, err)
+	}
+}
+
+func (e *deleteEvent) handle(c *Client) {
+	if _, err := deleteMessage(c.UserID, e.ID); err != nil {
+		sendEditError(c, err)
+	}
+}
+
+// clientEvents maps each frame type a client may send after authenticating
+// to a constructor for its payload.
+var clientEvents = map[string]func() clientEvent{
+	"message":        func() clientEvent { return &sendMessageEvent{} },
+	"reauth":         func() clientEvent { return &reauthEvent{} },
+	"typing":         func() clientEvent { return &startTypingEvent{} },
+	"presence":       func() clientEvent { return &setPresenceEvent{} },
+	"subscribe":      func() clientEvent { return &subscribeEvent{} },
+	receiptDelivered: func() clientEvent { return &markReceiptsEvent{state: receiptDelivered} },
+	receiptRead:      func() clientEvent { return &markReceiptsEvent{state: receiptRead} },
+	"edit":           func() clientEvent { return &editEvent{} },
+	"delete":         func() clientEvent { return &deleteEvent{} },
+	"react":          func() clientEvent { return &reactEvent{add: true} },
+	"unreact":        func() clientEvent { return &reactEvent{add: false} },
+}
+
+// ================= ENCODING =================
+
+// derefID returns *id, or 0 for nil, matching the omitempty IDs of events.
+func derefID(id *uint) uint {
+	if id == nil {
+		return 0
+	}
+	return *id
+}
+
+// encodedEvent is an event rendered once in each wire format, so fan-out
+// doesn't re-encode it per client.
+type encodedEvent struct {
+	flat     []byte
+	envelope []byte
+}
+
+var (
+	framePrefix = newNodeID()[:8]
+	frameSeq    atomic.Uint64
+)
+
+// newFrameID returns an ID unique to this process's outbound frames.
+func newFrameID() string {
+	return framePrefix + "-" + strconv.FormatUint(frameSeq.Add(1), 10)
+}
+
+// encodeEvent renders ev as a flat frame and as an envelope. Events are
+// plain structs, so a failure is a programming error.
+func encodeEvent(ev serverEvent) encodedEvent {
+	payload := mustEncode(ev)
+	typ := ev.eventType()
+
+	// Splice the type into the payload object for the flat format.
+	flat := []byte(`{"type":` + strconv.Quote(typ))
+	if body := bytes.TrimPrefix(payload, []byte("{")); len(body) > 1 {
+		flat = append(flat, ',')
+		flat = append(flat, body...)
+	} else {
+		flat = append(flat, '}')
+	}
+
+	return encodedEvent{
+		flat:     flat,
+		envelope: mustEncode(envelope{Type: typ, ID: newFrameID(), TS: time.Now(), Payload: payload}),
+	}
+}
+
+// forClient picks the format c negotiated.
+func (e encodedEvent) forClient(c *Client) []byte {
+	if c.protocol == protocolV1 {
+		return e.envelope
+	}
+	return e.flat
+}
+
+// ================= DECODING =================
+
+// decodeStrict unmarshals data into v, rejecting unknown fields and
+// trailing data.
+func decodeStrict(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if dec.More() {
+		return errors.New("unexpected data after frame")
+	}
+	return nil
+}
+
+// decodeAuth reads the first frame of a connection.
+func decodeAuth(c *Client, data []byte) (authEvent, error) {
+	var auth authEvent
+	if c.protocol != protocolV1 {
+		err := json.Unmarshal(data, &auth)
+		return auth, err
+	}
+
+	var env envelope
+	if err := decodeStrict(data, &env); err != nil {
+		return auth, err
+	}
+	if env.Type != "auth" {
+		return auth, fmt.Errorf("%w %q, want auth", errUnknownType, env.Type)
+	}
+	return auth, decodeStrict(env.Payload, &auth)
+}
+
+// decodeClientEvent reads a frame sent after authentication, returning its
+// type, envelope ID (empty for flat frames) and payload.
+//
+// Flat frames are decoded leniently as before: unknown fields are ignored
+// and a missing type is a chat message, but a type that is set must be
+// known. Envelopes must name a known type and match its payload exactly.
+func decodeClientEvent(c *Client, data []byte) (string, string, clientEvent, error) {
+	if c.protocol != protocolV1 {
+		var head struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(data, &head); err != nil {
+			return "", "", nil, err
+		}
+		if head.Type == "" {
+			head.Type = "message"
+		}
+		newEvent := clientEvents[head.Type]
+		if newEvent == nil {
+			return head.Type, "", nil, fmt.Errorf("%w %q", errUnknownType, head.Type)
+		}
+		ev := newEvent()
+		return head.Type, "", ev, json.Unmarshal(data, ev)
+	}
+
+	var env envelope
+	if err := decodeStrict(data, &env); err != nil {
+		return "", "", nil, fmt.Errorf("%w: %v", errInvalidPayload, err)
+	}
+	newEvent := clientEvents[env.Type]
+	if newEvent == nil {
+		return env.Type, env.ID, nil, fmt.Errorf("%w %q", errUnknownType, env.Type)
+	}
+	ev := newEvent()
+	if err := decodeStrict(env.Payload, ev); err != nil {
+		return env.Type, env.ID, nil, fmt.Errorf("%w: %v", errInvalidPayload, err)
+	}
+	return env.Type, env.ID, ev, nil
+}
+
+// sendDecodeError answers a frame that couldn't be decoded.
+func sendDecodeError(c *Client, err error) {
+	if errors.Is(err, errUnknownType) {
+		sendError(c, "unknown_type", err.Error())
+		return
+	}
+	sendError(c, "invalid_frame", err.Error())
+}
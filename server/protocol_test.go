@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestEncodeEvent(t *testing.T) {
+	frame := encodeEvent(systemEvent{Content: "hello", Room: 3})
+
+	var flat map[string]interface{}
+	if err := json.Unmarshal(frame.flat, &flat); err != nil {
+		t.Fatalf("flat frame %s: %v", frame.flat, err)
+	}
+	if flat["type"] != "system" || flat["content"] != "hello" || flat["room"] != float64(3) {
+		t.Errorf("flat frame = %v", flat)
+	}
+
+	var env envelope
+	if err := decodeStrict(frame.envelope, &env); err != nil {
+		t.Fatalf("envelope %s: %v", frame.envelope, err)
+	}
+	if env.Type != "system" || env.ID == "" || env.TS.IsZero() {
+		t.Errorf("envelope = %+v", env)
+	}
+	if string(env.Payload) != `{"content":"hello","room":3}` {
+		t.Errorf("payload = %s", env.Payload)
+	}
+
+	// An event with no fields still gets its type.
+	empty := encodeEvent(missedEvent{}).flat
+	if !bytes.HasPrefix(empty, []byte(`{"type":"missed"`)) || !json.Valid(empty) {
+		t.Errorf("flat frame = %s", empty)
+	}
+}
+
+func TestDecodeClientEvent(t *testing.T) {
+	flat := &Client{}
+	v1 := &Client{protocol: protocolV1}
+
+	tests := []struct {
+		name     string
+		client   *Client
+		frame    string
+		wantType string
+		wantErr  error
+	}{
+		{"envelope", v1, `{"type":"edit","id":"f1","ts":"2024-01-01T00:00:00Z","payload":{"id":4,"content":"x"}}`, "edit", nil},
+		{"unknown type", v1, `{"type":"shout","id":"f1","payload":{}}`, "shout", errUnknownType},
+		{"unknown payload field", v1, `{"type":"edit","id":"f1","payload":{"id":4,"body":"x"}}`, "edit", errInvalidPayload},
+		{"unknown envelope field", v1, `{"type":"edit","id":"f1","payload":{},"extra":1}`, "", errInvalidPayload},
+		{"flat frame without a type", flat, `{"content":"hi","recipient":"bob"}`, "message", nil},
+		{"flat frame with extra fields", flat, `{"type":"delete","id":4,"note":"ignored"}`, "delete", nil},
+		{"flat frame with an unknown type", flat, `{"type":"shout","content":"hi"}`, "shout", errUnknownType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			typ, _, ev, err := decodeClientEvent(tt.client, []byte(tt.frame))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("decodeClientEvent() error = %v, want %v", err, tt.wantErr)
+			}
+			if typ != tt.wantType {
+				t.Errorf("type = %q, want %q", typ, tt.wantType)
+			}
+			if err == nil && ev == nil {
+				t.Error("event = nil")
+			}
+		})
+	}
+
+	_, _, ev, _ := decodeClientEvent(v1, []byte(`{"type":"unreact","id":"f1","payload":{"id":4,"emoji":"👍"}}`))
+	if r, ok := ev.(*reactEvent); !ok || r.add || r.ID != 4 {
+		t.Errorf("unreact event = %#v", ev)
+	}
+}
+
+func TestProtocolSchemaUpToDate(t *testing.T) {
+	want, err := json.MarshalIndent(protocolSchema(), "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile("../client/protocol.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bytes.TrimSpace(got), want) {
+		t.Error("client/protocol.schema.json is stale; run go generate in server/")
+	}
+}
+
+func TestEnvelopeProtocol(t *testing.T) {
+	resetStore(t)
+	srv := httptest.NewServer(routes())
+	defer srv.Close()
+	_, tokens := register(t, "alice")
+
+	dialer := websocket.Dialer{Subprotocols: []string{protocolV1}}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	if conn.Subprotocol() != protocolV1 {
+		t.Fatalf("Subprotocol() = %q, want %q", conn.Subprotocol(), protocolV1)
+	}
+
+	send := func(typ, id string, payload interface{}) {
+		t.Helper()
+		data, _ := json.Marshal(payload)
+		err := conn.WriteJSON(envelope{Type: typ, ID: id, TS: time.Now(), Payload: data})
+		if err != nil {
+			t.Fatalf("WriteJSON() error = %v", err)
+		}
+	}
+	next := func(typ string) envelope {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("ReadMessage() error = %v", err)
+			}
+			var env envelope
+			if err := decodeStrict(data, &env); err != nil {
+				t.Fatalf("frame %s is not an envelope: %v", data, err)
+			}
+			if env.Type == typ {
+				return env
+			}
+		}
+	}
+
+	send("auth", "f1", authEvent{Token: tokens.Token})
+	next("system")
+
+	send("shout", "f2", map[string]string{})
+	var e errorEvent
+	if err := json.Unmarshal(next("error").Payload, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Code != "unknown_type" || e.Ref != "f2" {
+		t.Errorf("error = %+v, want unknown_type for f2", e)
+	}
+
+	send("message", "f3", sendMessageEvent{ClientID: "c1", Content: "hello"})
+	var ack ackEvent
+	if err := json.Unmarshal(next("ack").Payload, &ack); err != nil {
+		t.Fatal(err)
+	}
+	if ack.ClientID != "c1" || ack.ID == 0 {
+		t.Errorf("ack = %+v", ack)
+	}
+
+	send("message", "f4", sendMessageEvent{ClientID: "c2", Content: "  "})
+	if err := json.Unmarshal(next("error").Payload, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Code != "invalid_content" || e.Ref != "f4" {
+		t.Errorf("error = %+v, want invalid_content for f4", e)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// maxFrameSize caps an inbound websocket frame; larger frames close the
+	// connection with "message too big".
+	maxFrameSize = 16 << 10
+
+	// maxContentLength caps a message's content, in runes.
+	maxContentLength = 4000
+
+	// Each user may send messageBurst messages at once, refilled at one
+	// per messageInterval, across all of their connections.
+	messageBurst    = 10
+	messageInterval = 500 * time.Millisecond
+
+	// A user who is throttled strikesBeforeMute times within strikeWindow
+	// is muted for muteDuration.
+	strikesBeforeMute = 5
+	strikeWindow      = time.Minute
+	muteDuration      = 2 * time.Minute
+
+	// maxSlowMode is the longest gap a room can enforce between messages.
+	maxSlowMode = 6 * 60 * 60
+
+	// Users whose limits have gone back to their defaults are forgotten
+	// this often.
+	limiterSweepInterval = time.Minute
+)
+
+// userLimit is the flood-control state of one user.
+type userLimit struct {
+	tokens     float64
+	refilledAt time.Time
+
+	strikes     int
+	firstStrike time.Time
+	mutedUntil  time.Time
+
+	roomPosts map[uint]time.Time // last message per slow-mode room
+}
+
+// limiter tracks message rates per user. It is shared by every connection
+// of a user so opening more sockets doesn't buy more throughput.
+type limiter struct {
+	mu      sync.Mutex
+	users   map[uint]*userLimit
+	now     func() time.Time
+	sweptAt time.Time
+}
+
+var limits = newLimiter()
+
+func newLimiter() *limiter {
+	return &limiter{users: make(map[uint]*userLimit), now: time.Now}
+}
+
+// throttle says why a message was refused and when the sender may retry.
+type throttle struct {
+	code  string // rate_limited, muted or slow_mode
+	until time.Time
+}
+
+func (l *limiter) user(userID uint, now time.Time) *userLimit {
+	if now.Sub(l.sweptAt) >= limiterSweepInterval {
+		l.sweep(now)
+	}
+
+	u := l.users[userID]
+	if u == nil {
+		u = &userLimit{tokens: messageBurst, refilledAt: now}
+		l.users[userID] = u
+	}
+	return u
+}
+
+// sweep forgets users who have a full bucket, no mute or recent strikes and
+// no slow-mode post that could still hold them back, so the map doesn't
+// grow with every user ever seen. l.mu must be held.
+func (l *limiter) sweep(now time.Time) {
+	l.sweptAt = now
+	for id, u := range l.users {
+		for room, at := range u.roomPosts {
+			if now.Sub(at) >= maxSlowMode*time.Second {
+				delete(u.roomPosts, room)
+			}
+		}
+
+		full := u.tokens+float64(now.Sub(u.refilledAt))/float64(messageInterval) >= messageBurst
+		if full && !now.Before(u.mutedUntil) && now.Sub(u.firstStrike) > strikeWindow && len(u.roomPosts) == 0 {
+			delete(l.users, id)
+		}
+	}
+}
+
+// take spends one of userID's message tokens. Running out counts as a
+// strike, and enough strikes in a row mute the user.
+func (l *limiter) take(userID uint) *throttle {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	u := l.user(userID, now)
+
+	if now.Before(u.mutedUntil) {
+		return &throttle{code: "muted", until: u.mutedUntil}
+	}
+
+	u.tokens = min(messageBurst, u.tokens+float64(now.Sub(u.refilledAt))/float64(messageInterval))
+	u.refilledAt = now
+	if u.tokens >= 1 {
+		u.tokens--
+		return nil
+	}
+
+	if now.Sub(u.firstStrike) > strikeWindow {
+		u.strikes, u.firstStrike = 0, now
+	}
+	u.strikes++
+	if u.strikes >= strikesBeforeMute {
+		u.strikes = 0
+		u.mutedUntil = now.Add(muteDuration)
+		return &throttle{code: "muted", until: u.mutedUntil}
+	}
+
+	wait := time.Duration((1 - u.tokens) * float64(messageInterval))
+	return &throttle{code: "rate_limited", until: now.Add(wait)}
+}
+
+// slowMode refuses a message from userID to room if the room's slow mode
+// interval hasn't passed since their last one.
+func (l *limiter) slowMode(userID uint, room Room) *throttle {
+	if room.SlowMode <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	next := l.user(userID, now).roomPosts[room.ID].Add(time.Duration(room.SlowMode) * time.Second)
+	if now.Before(next) {
+		return &throttle{code: "slow_mode", until: next}
+	}
+	return nil
+}
+
+// roomPosted records a message from userID stored in room, starting their
+// slow mode interval.
+func (l *limiter) roomPosted(userID uint, room Room) {
+	if room.SlowMode <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	u := l.user(userID, now)
+	if u.roomPosts == nil {
+		u.roomPosts = make(map[uint]time.Time)
+	}
+	u.roomPosts[room.ID] = now
+}
+
+// sendThrottled tells c its message was dropped and when to try again.
+func sendThrottled(c *Client, t *throttle) {
+	content := "You are sending messages too quickly"
+	switch t.code {
+	case "muted":
+		content = "You have been muted for flooding"
+	case "slow_mode":
+		content = "This room is in slow mode"
+	}
+
+	retry := max(time.Until(t.until).Milliseconds(), 0)
+	c.refuse(errorEvent{
+		Code:         t.code,
+		Content:      content,
+		Ref:          c.frameID,
+		RetryAfterMs: &retry,
+		Until:        &t.until,
+	})
+}
+
+// rateLimited reports whether an inbound frame of frameType costs a
+// message token. Typing, presence and receipts are cheap and exempt.
+func rateLimited(frameType string) bool {
+	switch frameType {
+	case "reauth", "typing", "presence", "subscribe", receiptDelivered, receiptRead:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock returns a limiter whose time only moves when advance is called.
+func fakeClock() (*limiter, func(time.Duration)) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newLimiter()
+	l.now = func() time.Time { return now }
+	return l, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestLimiterBurstAndRefill(t *testing.T) {
+	l, advance := fakeClock()
+
+	for i := 0; i < messageBurst; i++ {
+		if th := l.take(1); th != nil {
+			t.Fatalf("take() #%d = %+v, want allowed within the burst", i+1, th)
+		}
+	}
+	th := l.take(1)
+	if th == nil || th.code != "rate_limited" {
+		t.Fatalf("take() after burst = %+v, want rate_limited", th)
+	}
+
+	// Another user has their own bucket.
+	if th := l.take(2); th != nil {
+		t.Errorf("take() for another user = %+v, want allowed", th)
+	}
+
+	advance(messageInterval)
+	if th := l.take(1); th != nil {
+		t.Errorf("take() after refill = %+v, want allowed", th)
+	}
+}
+
+func TestLimiterMutesRepeatOffenders(t *testing.T) {
+	l, advance := fakeClock()
+
+	for i := 0; i < messageBurst; i++ {
+		l.take(1)
+	}
+	var th *throttle
+	for i := 0; i < strikesBeforeMute; i++ {
+		th = l.take(1)
+	}
+	if th == nil || th.code != "muted" {
+		t.Fatalf("take() after %d strikes = %+v, want muted", strikesBeforeMute, th)
+	}
+
+	// Waiting for tokens doesn't help while muted.
+	advance(muteDuration / 2)
+	if th := l.take(1); th == nil || th.code != "muted" {
+		t.Errorf("take() during mute = %+v, want muted", th)
+	}
+
+	advance(muteDuration / 2)
+	if th := l.take(1); th != nil {
+		t.Errorf("take() after mute = %+v, want allowed", th)
+	}
+}
+
+func TestLimiterSlowMode(t *testing.T) {
+	l, advance := fakeClock()
+	room := Room{ID: 1, SlowMode: 30}
+
+	if th := l.slowMode(1, room); th != nil {
+		t.Fatalf("slowMode() first message = %+v, want allowed", th)
+	}
+	// Only a stored message starts the interval.
+	if th := l.slowMode(1, room); th != nil {
+		t.Fatalf("slowMode() before a message was stored = %+v, want allowed", th)
+	}
+	l.roomPosted(1, room)
+	th := l.slowMode(1, room)
+	if th == nil || th.code != "slow_mode" {
+		t.Fatalf("slowMode() second message = %+v, want slow_mode", th)
+	}
+	if want := l.now().Add(30 * time.Second); !th.until.Equal(want) {
+		t.Errorf("until = %v, want %v", th.until, want)
+	}
+
+	if th := l.slowMode(1, Room{ID: 2, SlowMode: 30}); th != nil {
+		t.Errorf("slowMode() in another room = %+v, want allowed", th)
+	}
+	if th := l.slowMode(1, Room{ID: 1}); th != nil {
+		t.Errorf("slowMode() with slow mode off = %+v, want allowed", th)
+	}
+
+	advance(30 * time.Second)
+	if th := l.slowMode(1, room); th != nil {
+		t.Errorf("slowMode() after the interval = %+v, want allowed", th)
+	}
+}
+
+func TestLimiterForgetsIdleUsers(t *testing.T) {
+	l, advance := fakeClock()
+	room := Room{ID: 1, SlowMode: 60}
+
+	l.take(1)
+	l.take(2)
+	l.roomPosted(2, room)
+
+	// User 1's bucket has refilled; user 2 has a slow-mode post that could
+	// still count.
+	advance(limiterSweepInterval)
+	l.take(3)
+	if _, ok := l.users[1]; ok {
+		t.Error("idle user 1 still tracked")
+	}
+	if _, ok := l.users[2]; !ok {
+		t.Fatal("user 2 forgotten while in slow mode")
+	}
+
+	advance(maxSlowMode * time.Second)
+	l.take(3)
+	if len(l.users) != 1 {
+		t.Errorf("tracked users = %d, want only the latest sender", len(l.users))
+	}
+	if th := l.slowMode(2, room); th != nil {
+		t.Errorf("slowMode() after being forgotten = %+v, want allowed", th)
+	}
+}
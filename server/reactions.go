@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Long enough for multi-codepoint emoji such as flags and ZWJ sequences.
+const maxEmojiLength = 32
+
+// Reaction is one user's emoji on a message. A user can add each emoji to a
+// message once.
+type Reaction struct {
+	MessageID uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"primaryKey"`
+	Emoji     string `gorm:"primaryKey;size:32"`
+	CreatedAt time.Time
+}
+
+type reactionSummary struct {
+	Emoji string   `json:"emoji"`
+	Count int      `json:"count"`
+	Users []string `json:"users"`
+}
+
+// summarizeReactions aggregates the reactions on each message in order of
+// first use.
+func summarizeReactions(messageIDs []uint) map[uint][]reactionSummary {
+	summaries := make(map[uint][]reactionSummary)
+	if len(messageIDs) == 0 {
+		return summaries
+	}
+
+	reactions, _ := store.Reactions(messageIDs)
+	if len(reactions) == 0 {
+		return summaries
+	}
+
+	userIDs := make([]uint, 0, len(reactions))
+	for _, r := range reactions {
+		userIDs = append(userIDs, r.UserID)
+	}
+	names := usernamesByID(userIDs)
+
+	for _, r := range reactions {
+		list := summaries[r.MessageID]
+		i := 0
+		for i < len(list) && list[i].Emoji != r.Emoji {
+			i++
+		}
+		if i == len(list) {
+			list = append(list, reactionSummary{Emoji: r.Emoji})
+		}
+		list[i].Count++
+		list[i].Users = append(list[i].Users, names[r.UserID])
+		summaries[r.MessageID] = list
+	}
+	return summaries
+}
+
+func validEmoji(emoji string) bool {
+	return emoji != "" &&
+		len(emoji) <= maxEmojiLength &&
+		utf8.ValidString(emoji) &&
+		!strings.ContainsAny(emoji, " \t\r\n")
+}
+
+// handleReaction adds or removes the client's reaction and sends the new
+// totals to everyone in the message's conversation.
+func handleReaction(client *Client, messageID uint, emoji string, add bool) {
+	if !validEmoji(emoji) {
+		sendError(client, "invalid_emoji", "Invalid emoji")
+		return
+	}
+
+	m, err := store.Message(messageID)
+	if errors.Is(err, errNotFound) || (err == nil && !canViewMessage(client.UserID, m)) {
+		sendError(client, "unknown_message", "Message does not exist")
+		return
+	}
+	if err != nil {
+		sendError(client, "internal", "Could not update reaction")
+		return
+	}
+	if m.DeletedAt != nil {
+		sendError(client, "message_deleted", "Message was deleted")
+		return
+	}
+
+	reaction := Reaction{MessageID: m.ID, UserID: client.UserID, Emoji: emoji}
+	var changed bool
+	if add {
+		changed, err = store.AddReaction(&reaction)
+	} else {
+		changed, err = store.RemoveReaction(reaction)
+	}
+	if err != nil {
+		sendError(client, "internal", "Could not update reaction")
+		return
+	}
+	if !changed {
+		return
+	}
+
+	reactions := summarizeReactions([]uint{m.ID})[m.ID]
+	if reactions == nil {
+		reactions = []reactionSummary{}
+	}
+	broadcastToAudience(m, reactionsEvent{ID: m.ID, Reactions: reactions, Room: derefID(m.RoomID)})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	receiptDelivered = "delivered"
+	receiptRead      = "read"
+
+	// Upper bound on message IDs acknowledged in one receipt frame.
+	maxReceiptBatch = 100
+)
+
+// MessageReceipt tracks whether one recipient's client has received and
+// displayed a message.
+type MessageReceipt struct {
+	MessageID   uint `gorm:"primaryKey"`
+	UserID      uint `gorm:"primaryKey;index"`
+	DeliveredAt *time.Time
+	ReadAt      *time.Time
+}
+
+// storeMessage persists msg together with a pending receipt for each
+// recipient, and links its uploaded attachments to it.
+func storeMessage(msg *Message, recipientIDs []uint) error {
+	return store.CreateMessage(msg, recipientIDs)
+}
+
+// handleReceipt records that the client's user has received or read the
+// given messages and tells each sender which of their messages changed.
+func handleReceipt(client *Client, state string, messageIDs []uint) {
+	if len(messageIDs) == 0 {
+		return
+	}
+	if len(messageIDs) > maxReceiptBatch {
+		messageIDs = messageIDs[:maxReceiptBatch]
+	}
+
+	// Receipts come from the device that got the messages, so they also
+	// confirm its offline queue position.
+	advanceDeviceCursor(client.UserID, client.Device, messageIDs)
+
+	// Only receipts that actually change are reported, so replays and
+	// duplicate frames don't produce duplicate events.
+	now := time.Now()
+	changed, err := store.MarkReceipts(client.UserID, messageIDs, state, now)
+	if err != nil || len(changed) == 0 {
+		return
+	}
+
+	msgs, _ := store.MessagesByID(changed)
+
+	bySender := make(map[uint][]uint)
+	for _, m := range msgs {
+		bySender[m.SenderID] = append(bySender[m.SenderID], m.ID)
+	}
+
+	for senderID, ids := range bySender {
+		frame := receiptEvent{State: state, User: client.Username, MessageIDs: ids, Timestamp: now}
+		// The reader's own sessions hear about reads too, so unread badges
+		// clear on every device.
+		if state == receiptRead && senderID != client.UserID {
+			hub.sendToUsers(frame, senderID, client.UserID)
+		} else {
+			hub.sendToUsers(frame, senderID)
+		}
+	}
+}
+
+// receiptStatus summarises the receipts of messages sent by the viewer:
+// "read" once every recipient has read it, "delivered" once every recipient
+// has received it, "sent" otherwise.
+func receiptStatus(messageIDs []uint) map[uint]string {
+	status := make(map[uint]string, len(messageIDs))
+	if len(messageIDs) == 0 {
+		return status
+	}
+
+	rows, _ := store.ReceiptCounts(messageIDs)
+
+	for _, id := range messageIDs {
+		status[id] = "sent"
+	}
+	for _, r := range rows {
+		switch {
+		case r.Read == r.Total:
+			status[r.MessageID] = receiptRead
+		case r.Delivered == r.Total:
+			status[r.MessageID] = receiptDelivered
+		}
+	}
+	return status
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Room is a group conversation. Only members receive its messages.
+type Room struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Name      string    `gorm:"not null" json:"name"`
+	CreatedBy uint      `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	SlowMode  int       `gorm:"not null;default:0" json:"slow_mode"` // seconds between a member's messages, 0 when off
+}
+
+// RoomMember links a user to a room they have joined.
+type RoomMember struct {
+	RoomID   uint   `gorm:"primaryKey"`
+	UserID   uint   `gorm:"primaryKey"`
+	Role     string `gorm:"not null;default:'member'"`
+	JoinedAt time.Time
+}
+
+// roomMemberIDs returns the set of user IDs that belong to roomID.
+func roomMemberIDs(roomID uint) map[uint]bool {
+	ids, _ := store.RoomMemberIDs(roomID)
+
+	members := make(map[uint]bool, len(ids))
+	for _, id := range ids {
+		members[id] = true
+	}
+	return members
+}
+
+func isRoomMember(roomID, userID uint) bool {
+	ok, _ := store.IsRoomMember(roomID, userID)
+	return ok
+}
+
+// handleRoomMessage stores a message sent to a room and fans it out to the
+// room's members.
+func handleRoomMessage(sender *Client, roomID uint, msg Message) *Message {
+	room, err := store.Room(roomID)
+	if err != nil {
+		sendError(sender, "unknown_room", "Room does not exist")
+		return nil
+	}
+
+	members := roomMemberIDs(room.ID)
+	if !members[sender.UserID] {
+		sendError(sender, "not_member", "You are not a member of "+room.Name)
+		return nil
+	}
+
+	if mute, ok := activeSanction(room.ID, sender.UserID, sanctionMute); ok {
+		sender.refuse(errorEvent{
+			Code:    "room_muted",
+			Content: "You are muted in " + room.Name,
+			Ref:     sender.frameID,
+			Until:   mute.ExpiresAt,
+		})
+		return nil
+	}
+
+	// Moderators aren't held to the room's slow mode.
+	slowed := !isRoomModerator(room, sender.UserID)
+	if slowed {
+		if t := limits.slowMode(sender.UserID, room); t != nil {
+			sendThrottled(sender, t)
+			return nil
+		}
+	}
+
+	recipients := make([]uint, 0, len(members))
+	for id := range members {
+		if id != sender.UserID {
+			recipients = append(recipients, id)
+		}
+	}
+
+	msg.RoomID = &room.ID
+	if err := storeMessage(&msg, recipients); err != nil {
+		sendError(sender, "internal", "Could not store message")
+		return nil
+	}
+	if slowed {
+		limits.roomPosted(sender.UserID, room)
+	}
+
+	stopTyping(sender.UserID, conversation{RoomID: room.ID})
+	broadcastMessage(room.ID, sender.Username, msg)
+	return &msg
+}
+
+// ================= ROOM HANDLERS =================
+
+type roomView struct {
+	Room
+	Members int64 `json:"members"`
+	Joined  bool  `json:"joined"`
+}
+
+func listRoomsHandler(w http.ResponseWriter, r *http.Request, user User) {
+	rooms, err := store.Rooms()
+	if err != nil {
+		http.Error(w, "Could not load rooms", http.StatusInternalServerError)
+		return
+	}
+
+	list := make([]roomView, 0, len(rooms))
+	for _, room := range rooms {
+		members := roomMemberIDs(room.ID)
+
+		list = append(list, roomView{
+			Room:    room,
+			Members: int64(len(members)),
+			Joined:  members[user.ID],
+		})
+	}
+
+	json.NewEncoder(w).Encode(list)
+}
+
+func createRoomHandler(w http.ResponseWriter, r *http.Request, user User) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		http.Error(w, "Room name required", http.StatusBadRequest)
+		return
+	}
+
+	room := Room{Name: name, CreatedBy: user.ID, CreatedAt: time.Now()}
+	if err := store.CreateRoom(&room); err != nil {
+		http.Error(w, "Could not create room", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(room)
+}
+
+// updateRoomHandler changes a room's settings. Only its moderators may.
+func updateRoomHandler(w http.ResponseWriter, r *http.Request, user User) {
+	m, ok := moderatorFromPath(w, r, user)
+	if !ok {
+		return
+	}
+	room := m.room
+
+	var req struct {
+		SlowMode *int `json:"slow_mode"` // seconds
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.SlowMode != nil {
+		if *req.SlowMode < 0 || *req.SlowMode > maxSlowMode {
+			http.Error(w, fmt.Sprintf("slow_mode must be between 0 and %d seconds", maxSlowMode), http.StatusBadRequest)
+			return
+		}
+		if err := store.SetRoomSlowMode(room.ID, *req.SlowMode); err != nil {
+			http.Error(w, "Could not update room", http.StatusInternalServerError)
+			return
+		}
+		room.SlowMode = *req.SlowMode
+		m.record(ModerationEntry{Action: actionSlowMode, Detail: strconv.Itoa(room.SlowMode)})
+		broadcastSystem(room.ID, fmt.Sprintf("Slow mode is %s", slowModeLabel(room.SlowMode)))
+	}
+
+	json.NewEncoder(w).Encode(room)
+}
+
+func slowModeLabel(seconds int) string {
+	if seconds == 0 {
+		return "off"
+	}
+	return "on: one message every " + (time.Duration(seconds) * time.Second).String()
+}
+
+func joinRoomHandler(w http.ResponseWriter, r *http.Request, user User) {
+	room, ok := roomFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if isRoomMember(room.ID, user.ID) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if _, banned := activeSanction(room.ID, user.ID, sanctionBan); banned {
+		http.Error(w, "You are banned from this room", http.StatusForbidden)
+		return
+	}
+
+	if err := store.AddRoomMember(room.ID, user.ID); err != nil {
+		http.Error(w, "Could not join room", http.StatusInternalServerError)
+		return
+	}
+
+	broadcastSystem(room.ID, user.Username+" joined "+room.Name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func leaveRoomHandler(w http.ResponseWriter, r *http.Request, user User) {
+	room, ok := roomFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	removed, err := store.RemoveRoomMember(room.ID, user.ID)
+	if err != nil {
+		http.Error(w, "Could not leave room", http.StatusInternalServerError)
+		return
+	}
+	if !removed {
+		http.Error(w, "Not a member of this room", http.StatusNotFound)
+		return
+	}
+
+	broadcastSystem(room.ID, user.Username+" left "+room.Name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// roomFromPath loads the room named by the {id} path segment, writing an
+// error response if it is missing or invalid.
+func roomFromPath(w http.ResponseWriter, r *http.Request) (Room, bool) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid room id", http.StatusBadRequest)
+		return Room{}, false
+	}
+
+	room, err := store.Room(uint(id))
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return room, false
+	}
+	if err != nil {
+		http.Error(w, "Could not load room", http.StatusInternalServerError)
+		return room, false
+	}
+
+	return room, true
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+//go:generate go run . -schema ../client/protocol.schema.json
+
+// protocolSchema describes the envelopes of protocolV1 as a JSON Schema
+// (draft 2020-12), derived from the event structs so it can't drift from
+// what the server sends and accepts. Frontends validate incoming frames
+// against #/$defs/serverFrame and outgoing ones against
+// #/$defs/clientFrame.
+func protocolSchema() map[string]interface{} {
+	b := schemaBuilder{defs: make(map[string]interface{})}
+
+	var server []interface{}
+	for _, ev := range serverEvents {
+		server = append(server, b.frame("server", ev.eventType(), reflect.TypeOf(ev)))
+	}
+
+	client := []interface{}{b.frame("client", "auth", reflect.TypeOf(authEvent{}))}
+	types := make([]string, 0, len(clientEvents))
+	for typ := range clientEvents {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	for _, typ := range types {
+		client = append(client, b.frame("client", typ, reflect.TypeOf(clientEvents[typ]())))
+	}
+
+	b.defs["serverFrame"] = map[string]interface{}{"oneOf": server}
+	b.defs["clientFrame"] = map[string]interface{}{"oneOf": client}
+
+	return map[string]interface{}{
+		"$schema":     "https://json-schema.org/draft/2020-12/schema",
+		"title":       protocolV1 + " websocket protocol",
+		"description": "Every frame is an envelope whose payload is selected by its type. Generated by `go generate` in server/; do not edit.",
+		"oneOf": []interface{}{
+			ref("serverFrame"),
+			ref("clientFrame"),
+		},
+		"$defs": b.defs,
+	}
+}
+
+// writeProtocolSchema writes the schema to path, formatted for review.
+func writeProtocolSchema(path string) error {
+	data, err := json.MarshalIndent(protocolSchema(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+type schemaBuilder struct {
+	defs map[string]interface{}
+}
+
+func ref(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/$defs/" + name}
+}
+
+// frame defines the envelope of one frame type, named side.type.
+func (b *schemaBuilder) frame(side, typ string, payload reflect.Type) map[string]interface{} {
+	name := side + "." + typ
+	b.defs[name] = map[string]interface{}{
+		"type":                 "object",
+		"required":             []string{"type", "id", "ts", "payload"},
+		"additionalProperties": false,
+		"properties": map[string]interface{}{
+			"type":    map[string]interface{}{"const": typ},
+			"id":      map[string]interface{}{"type": "string"},
+			"ts":      map[string]interface{}{"type": "string", "format": "date-time"},
+			"payload": b.schema(payload),
+		},
+	}
+	return ref(name)
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	rawType  = reflect.TypeOf(json.RawMessage{})
+)
+
+// schema returns the schema of values of t as encoding/json writes them.
+// Named structs become shared definitions.
+func (b *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	switch t {
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case rawType:
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return b.schema(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if _, ok := b.defs[t.Name()]; !ok {
+			b.defs[t.Name()] = nil // reserve the name in case t refers to itself
+			b.defs[t.Name()] = b.object(t)
+		}
+		return ref(t.Name())
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// object describes a struct: its exported fields, embedded ones flattened,
+// with those not marked omitempty required.
+func (b *schemaBuilder) object(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	required := []string{}
+	b.fields(t, properties, &required)
+
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"required":             required,
+		"additionalProperties": false,
+	}
+}
+
+func (b *schemaBuilder) fields(t reflect.Type, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			b.fields(f.Type, properties, required)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		s := b.schema(f.Type)
+		omitempty := strings.Contains(opts, "omitempty")
+		if !omitempty {
+			*required = append(*required, name)
+			// encoding/json writes nil pointers, slices and maps as null.
+			switch f.Type.Kind() {
+			case reflect.Pointer, reflect.Slice, reflect.Map:
+				s = map[string]interface{}{"anyOf": []interface{}{s, map[string]interface{}{"type": "null"}}}
+			}
+		}
+		properties[name] = s
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"html"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// searchConfig is the PostgreSQL text search configuration used both for
+// the index and for queries; they must match for the index to be used.
+const searchConfig = "english"
+
+const (
+	// Markers ts_headline wraps matches in. The snippet is HTML-escaped
+	// before they become <mark> tags; control bytes pass escaping unchanged,
+	// so they are removed from content before matches are marked.
+	snippetStart = "\x01"
+	snippetStop  = "\x02"
+
+	maxSearchQueryLength = 256
+
+	// Runes of content kept around the first match when search falls back
+	// to substring matching.
+	snippetLength = 160
+)
+
+type searchResult struct {
+	Message messageView `json:"message"`
+	Snippet string      `json:"snippet"`
+}
+
+// searchMessages returns up to limit live messages matching query, newest
+// first, with a highlighted snippet for each.
+func searchMessages(userID uint, query string, roomID, senderID uint, since *time.Time, cursor string, limit int) (results []searchResult, hasMore bool, err error) {
+	sq := searchQuery{
+		UserID:   userID,
+		Text:     query,
+		RoomID:   roomID,
+		SenderID: senderID,
+		Since:    since,
+		Limit:    limit + 1,
+	}
+	if cursor != "" {
+		ts, id, err := decodeCursor(cursor)
+		if err != nil {
+			return nil, false, err
+		}
+		sq.Before = &pagePos{Timestamp: ts, ID: id}
+	}
+
+	hits, err := store.SearchMessages(sq)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(hits) > limit {
+		hits = hits[:limit]
+		hasMore = true
+	}
+
+	msgs := make([]Message, 0, len(hits))
+	for _, hit := range hits {
+		msgs = append(msgs, hit.Message)
+	}
+	views := toMessageViews(userID, msgs)
+
+	results = make([]searchResult, 0, len(hits))
+	for i, hit := range hits {
+		results = append(results, searchResult{
+			Message: views[i],
+			Snippet: highlight(hit.Snippet),
+		})
+	}
+	return results, hasMore, nil
+}
+
+// searchTerms splits a query into the lower-cased words matched by stores
+// without full-text search.
+func searchTerms(query string) []string {
+	var terms []string
+	for _, field := range strings.Fields(strings.ToLower(query)) {
+		term := strings.Trim(field, `"'`)
+		if term != "" && !slices.Contains(terms, term) {
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+// markTerms is the ts_headline of stores without full-text search: it
+// wraps every occurrence of terms in the snippet markers, keeping a window
+// of content around the first match.
+func markTerms(content string, terms []string) string {
+	content = stripMarkers.Replace(content)
+	first := -1
+	var b strings.Builder
+	for i := 0; i < len(content); {
+		n := 0
+		for _, term := range terms {
+			if len(term) > n && len(content)-i >= len(term) && strings.EqualFold(content[i:i+len(term)], term) {
+				n = len(term)
+			}
+		}
+		if n == 0 {
+			_, size := utf8.DecodeRuneInString(content[i:])
+			b.WriteString(content[i : i+size])
+			i += size
+			continue
+		}
+
+		if first < 0 {
+			first = utf8.RuneCountInString(b.String())
+		}
+		b.WriteString(snippetStart + content[i:i+n] + snippetStop)
+		i += n
+	}
+
+	runes := []rune(b.String())
+	if len(runes) <= snippetLength {
+		return string(runes)
+	}
+
+	start := max(0, first-snippetLength/4)
+	end := min(len(runes), start+snippetLength)
+	snippet := string(runes[start:end])
+
+	// A cut through a match leaves one of its markers behind; restore the
+	// other so the marks stay balanced.
+	if strings.LastIndex(snippet, snippetStart) > strings.LastIndex(snippet, snippetStop) {
+		snippet += snippetStop
+	}
+	if stop := strings.Index(snippet, snippetStop); stop >= 0 {
+		if mark := strings.Index(snippet, snippetStart); mark < 0 || mark > stop {
+			snippet = snippetStart + snippet
+		}
+	}
+
+	if start > 0 {
+		snippet = "…" + snippet
+	}
+	if end < len(runes) {
+		snippet += "…"
+	}
+	return snippet
+}
+
+var stripMarkers = strings.NewReplacer(snippetStart, "", snippetStop, "")
+
+// highlight escapes a snippet and turns its match markers into <mark> tags,
+// so it is safe to render as HTML.
+func highlight(snippet string) string {
+	escaped := html.EscapeString(snippet)
+	escaped = strings.ReplaceAll(escaped, snippetStart, "<mark>")
+	return strings.ReplaceAll(escaped, snippetStop, "</mark>")
+}
+
+// ================= SEARCH HANDLER =================
+
+// searchHandler serves GET /search?q=&room=&sender=&from=&before=&limit=.
+// sender narrows results to one user's messages and from to those sent at
+// or after an RFC 3339 time; before is the next_cursor of a previous page.
+func searchHandler(w http.ResponseWriter, r *http.Request, user User) {
+	query := r.URL.Query()
+
+	text := strings.TrimSpace(query.Get("q"))
+	if text == "" {
+		http.Error(w, "Query required", http.StatusBadRequest)
+		return
+	}
+	if len(text) > maxSearchQueryLength {
+		http.Error(w, "Query too long", http.StatusBadRequest)
+		return
+	}
+
+	limit := historyDefaultLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, historyMaxLimit)
+	}
+
+	var roomID uint
+	if v := query.Get("room"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid room id", http.StatusBadRequest)
+			return
+		}
+		if !isRoomMember(uint(id), user.ID) {
+			http.Error(w, "Not a member of this room", http.StatusForbidden)
+			return
+		}
+		roomID = uint(id)
+	}
+
+	var senderID uint
+	if v := query.Get("sender"); v != "" {
+		sender, err := store.UserByName(v)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		senderID = sender.ID
+	}
+
+	var since *time.Time
+	if v := query.Get("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "Invalid from time", http.StatusBadRequest)
+			return
+		}
+		since = &t
+	}
+
+	before := query.Get("before")
+	if before != "" {
+		if _, _, err := decodeCursor(before); err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	results, hasMore, err := searchMessages(user.ID, text, roomID, senderID, since, before, limit)
+	if err != nil {
+		http.Error(w, "Search failed", http.StatusInternalServerError)
+		return
+	}
+
+	resp := struct {
+		Results    []searchResult `json:"results"`
+		NextCursor string         `json:"next_cursor,omitempty"`
+	}{
+		Results: results,
+	}
+	if hasMore {
+		last := results[len(results)-1].Message
+		resp.NextCursor = encodeCursor(Message{ID: last.ID, Timestamp: last.Timestamp})
+	}
+
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// drainTimeout bounds how long shutdown waits for connections to finish
+// their in-flight work before the process exits anyway.
+const drainTimeout = 15 * time.Second
+
+// connTracker counts websocket sessions so shutdown can refuse new ones and
+// wait for the rest to finish writing to the store.
+type connTracker struct {
+	mu       sync.Mutex
+	draining bool
+	active   sync.WaitGroup
+}
+
+var conns connTracker
+
+// enter reserves a slot for a new session. It fails once draining has
+// started.
+func (t *connTracker) enter() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return false
+	}
+	t.active.Add(1)
+	return true
+}
+
+func (t *connTracker) leave() {
+	t.active.Done()
+}
+
+func (t *connTracker) isDraining() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.draining
+}
+
+func (t *connTracker) drain() {
+	t.mu.Lock()
+	t.draining = true
+	t.mu.Unlock()
+}
+
+// wait blocks until every session has left or ctx is done.
+func (t *connTracker) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		t.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// closeAll sends every connected client a close frame with reason. Their
+// read loops then fail and run the usual disconnect cleanup.
+func closeAll(code int, reason string) {
+	var all []*Client
+	hub.do(func(clients map[*Client]bool) {
+		for c := range clients {
+			all = append(all, c)
+		}
+	})
+
+	var wg sync.WaitGroup
+	for _, c := range all {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.closeWith(code, reason)
+		}()
+	}
+	wg.Wait()
+}
+
+// shutdown drains the server: new upgrades are refused, open sockets are
+// told the server is restarting, sessions get until ctx's deadline to
+// finish their store writes, and then the HTTP server, broker and store are
+// closed.
+func shutdown(ctx context.Context, srv *http.Server) {
+	conns.drain()
+
+	closeAll(websocket.CloseServiceRestart, "server restarting")
+	if err := conns.wait(ctx); err != nil {
+		log.Println("Shutdown: gave up waiting for connections:", err)
+	}
+
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("Shutdown: HTTP server:", err)
+	}
+	if err := hub.leaveCluster(ctx); err != nil {
+		log.Println("Shutdown: leaving the cluster:", err)
+	}
+	if err := store.Close(); err != nil {
+		log.Println("Shutdown: closing store:", err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialChat opens an authenticated websocket session against srv and waits
+// until it is registered with the hub.
+func dialChat(t *testing.T, srv *httptest.Server, token string) *websocket.Conn {
+	t.Helper()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	if err := conn.WriteJSON(map[string]string{"token": token}); err != nil {
+		t.Fatalf("WriteJSON() error = %v", err)
+	}
+
+	// The user's own join announcement is sent once they are registered.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var frame map[string]interface{}
+		if err := conn.ReadJSON(&frame); err != nil {
+			t.Fatalf("ReadJSON() error = %v", err)
+		}
+		if content, _ := frame["content"].(string); strings.HasSuffix(content, " joined the chat") {
+			return conn
+		}
+	}
+}
+
+func TestShutdownDrainsConnections(t *testing.T) {
+	resetStore(t)
+	t.Cleanup(func() { conns = connTracker{} })
+
+	srv := httptest.NewServer(routes())
+	defer srv.Close()
+
+	_, tokens := register(t, "alice")
+	conn := dialChat(t, srv, tokens.Token)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	shutdown(ctx, srv.Config)
+
+	// The open socket is told why it is being closed.
+	for {
+		_, _, err := conn.ReadMessage()
+		var closeErr *websocket.CloseError
+		if errors.As(err, &closeErr) {
+			if closeErr.Code != websocket.CloseServiceRestart || closeErr.Text != "server restarting" {
+				t.Errorf("close = %d %q, want %d %q", closeErr.Code, closeErr.Text,
+					websocket.CloseServiceRestart, "server restarting")
+			}
+			break
+		}
+		if err != nil {
+			t.Fatalf("ReadMessage() error = %v, want a close frame", err)
+		}
+	}
+
+	// The session's cleanup ran before shutdown returned.
+	user, err := store.UserByName("alice")
+	if err != nil {
+		t.Fatalf("UserByName() error = %v", err)
+	}
+	if user.LastSeen == nil {
+		t.Error("LastSeen not recorded before shutdown returned")
+	}
+
+	// New upgrades are refused.
+	rec := httptest.NewRecorder()
+	routes().ServeHTTP(rec, httptest.NewRequest("GET", "/ws", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
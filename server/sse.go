@@ -0,0 +1,217 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Server-Sent Events are the fallback for clients whose proxies break
+// websockets. GET /events streams the envelopes a chat.v1 websocket would
+// receive, starting with a "session" event; the client sends each frame it
+// would have written to the socket with POST /events?session=<id>. Both
+// authenticate with the usual bearer token.
+
+// eventStream is the transport state of a Server-Sent Events or
+// long-polling client.
+type eventStream struct {
+	id    string
+	polls chan pollRequest // polls waiting for frames; nil for Server-Sent Events
+
+	ready   chan struct{} // closed once the session is registered
+	mu      sync.Mutex    // serialises frames posted to the session, as a socket's read loop would
+	refused *errorEvent   // why the frame being posted was refused; guarded by mu
+
+	done    chan struct{}
+	once    sync.Once
+	closing closeEvent
+}
+
+// stop ends the stream, telling the client why.
+func (s *eventStream) stop(code int, reason string) {
+	s.once.Do(func() {
+		s.closing = closeEvent{Code: code, Reason: reason}
+		close(s.done)
+	})
+}
+
+var streams = struct {
+	sync.Mutex
+	byID map[string]*Client
+}{byID: make(map[string]*Client)}
+
+// openStream authenticates a request opening a stream, for Server-Sent
+// Events or long polling, and builds the stream's client. It answers the
+// request itself and returns nil when it can't.
+func openStream(w http.ResponseWriter, r *http.Request) *Client {
+	claims, user, err := authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil
+	}
+	device := r.URL.Query().Get("device")
+	if len(device) > maxDeviceIDLength {
+		http.Error(w, "Device ID too long", http.StatusBadRequest)
+		return nil
+	}
+
+	id, err := randomToken()
+	if err != nil {
+		http.Error(w, "Could not open stream", http.StatusInternalServerError)
+		return nil
+	}
+
+	client := newClient(nil)
+	client.protocol = protocolV1
+	client.stream = &eventStream{id: id, ready: make(chan struct{}), done: make(chan struct{})}
+	client.identify(user, claims, device)
+	return client
+}
+
+// addStream lets frames be posted to the client's stream.
+func addStream(client *Client) {
+	streams.Lock()
+	streams.byID[client.stream.id] = client
+	streams.Unlock()
+}
+
+func removeStream(client *Client) {
+	streams.Lock()
+	delete(streams.byID, client.stream.id)
+	streams.Unlock()
+}
+
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if !conns.enter() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer conns.leave()
+
+	client := openStream(w, r)
+	if client == nil {
+		return
+	}
+	id := client.stream.id
+	addStream(client)
+	defer removeStream(client)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // stop nginx from holding events back
+	rc := http.NewResponseController(w)
+
+	write := func(chunk string) error {
+		if _, err := io.WriteString(w, chunk); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	if write(eventData(encodeEvent(sessionEvent{Session: id}).envelope)) != nil {
+		client.expiry.Stop()
+		return
+	}
+
+	// This goroutine is the stream's writer, so the session is set up
+	// alongside it: replaying history can fill the send buffer.
+	go func() {
+		startSession(client)
+		close(client.stream.ready)
+	}()
+
+	streamEvents(r, client, write)
+
+	// Let setup stop queuing, then wait for it to register the session.
+	close(client.stopped)
+	<-client.stream.ready
+	endSession(client)
+}
+
+func eventData(frame []byte) string {
+	return "data: " + string(frame) + "\n\n"
+}
+
+// streamEvents writes the client's frames until it disconnects, the hub
+// drops it or the session is stopped. Comments keep proxies from timing the
+// stream out.
+func streamEvents(r *http.Request, client *Client, write func(string) error) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case frame, ok := <-client.send:
+			if !ok || write(eventData(frame)) != nil {
+				return
+			}
+
+		case <-ticker.C:
+			if write(": ping\n\n") != nil {
+				return
+			}
+
+		case <-client.stream.done:
+			write(eventData(encodeEvent(client.stream.closing).envelope))
+			return
+
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// postEventHandler accepts one client frame for an open stream of the
+// user's. A refused frame is answered with the error event a websocket
+// would have been sent, and a status saying why.
+func postEventHandler(w http.ResponseWriter, r *http.Request, user User) {
+	streams.Lock()
+	client := streams.byID[r.URL.Query().Get("session")]
+	streams.Unlock()
+	if client == nil || client.UserID != user.ID {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxFrameSize))
+	if err != nil {
+		http.Error(w, "Frame too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	select {
+	case <-client.stream.ready:
+	case <-r.Context().Done():
+		return
+	}
+
+	client.stream.mu.Lock()
+	client.handleFrame(data)
+	refused := client.stream.refused
+	client.stream.refused = nil
+	client.stream.mu.Unlock()
+
+	if refused == nil {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(refusalStatus(refused.Code))
+	w.Write(encodeEvent(*refused).envelope)
+}
+
+// refusalStatus is the HTTP status of a POSTed frame refused with an error
+// event of code.
+func refusalStatus(code string) int {
+	switch code {
+	case "rate_limited", "muted", "slow_mode":
+		return http.StatusTooManyRequests
+	case "forbidden", "not_member", "room_muted":
+		return http.StatusForbidden
+	case "internal":
+		return http.StatusInternalServerError
+	default:
+		return http.StatusUnprocessableEntity
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventStream(t *testing.T) {
+	resetStore(t)
+	srv := httptest.NewServer(routes())
+	defer srv.Close()
+	_, alice := register(t, "alice")
+	_, bob := register(t, "bob")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/events?device=d1", nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /events error = %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("GET /events without a token status = %d, want 401", res.StatusCode)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+alice.Token)
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /events error = %v", err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q, want text/event-stream", ct)
+	}
+
+	events := bufio.NewReader(res.Body)
+	next := func(typ string) envelope {
+		t.Helper()
+		for {
+			line, err := events.ReadString('\n')
+			if err != nil {
+				t.Fatalf("reading stream error = %v", err)
+			}
+			data, ok := strings.CutPrefix(strings.TrimSuffix(line, "\n"), "data: ")
+			if !ok {
+				continue
+			}
+			var env envelope
+			if err := decodeStrict([]byte(data), &env); err != nil {
+				t.Fatalf("event %s is not an envelope: %v", data, err)
+			}
+			if env.Type == typ {
+				return env
+			}
+		}
+	}
+	post := func(session, token string, frame []byte) (int, []byte) {
+		t.Helper()
+		req, _ := http.NewRequest("POST", srv.URL+"/events?session="+session, bytes.NewReader(frame))
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST /events error = %v", err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return res.StatusCode, body
+	}
+
+	var session sessionEvent
+	if err := json.Unmarshal(next("session").Payload, &session); err != nil {
+		t.Fatal(err)
+	}
+	if session.Session == "" {
+		t.Fatal("session event has no session ID")
+	}
+
+	payload, _ := json.Marshal(sendMessageEvent{ClientID: "c1", Content: "hello"})
+	frame, _ := json.Marshal(envelope{Type: "message", ID: "f1", TS: time.Now(), Payload: payload})
+
+	if code, _ := post(session.Session, alice.Token, frame); code != http.StatusAccepted {
+		t.Fatalf("POST /events status = %d, want 202", code)
+	}
+	var ack ackEvent
+	if err := json.Unmarshal(next("ack").Payload, &ack); err != nil {
+		t.Fatal(err)
+	}
+	if ack.ClientID != "c1" || ack.ID == 0 {
+		t.Errorf("ack = %+v", ack)
+	}
+
+	t.Run("refused frame", func(t *testing.T) {
+		payload, _ := json.Marshal(sendMessageEvent{ClientID: "c2", Content: " "})
+		blank, _ := json.Marshal(envelope{Type: "message", ID: "f2", TS: time.Now(), Payload: payload})
+		code, body := post(session.Session, alice.Token, blank)
+		if code != http.StatusUnprocessableEntity {
+			t.Fatalf("POST /events status = %d, want 422", code)
+		}
+		var env envelope
+		var refusal errorEvent
+		if err := decodeStrict(body, &env); err != nil || env.Type != "error" {
+			t.Fatalf("response %s is not an error event: %v", body, err)
+		}
+		if err := json.Unmarshal(env.Payload, &refusal); err != nil || refusal.Code != "invalid_content" || refusal.Ref != "f2" {
+			t.Errorf("refusal = %+v, %v, want invalid_content for f2", refusal, err)
+		}
+	})
+
+	t.Run("foreign session", func(t *testing.T) {
+		if code, _ := post(session.Session, bob.Token, frame); code != http.StatusNotFound {
+			t.Errorf("POST /events as another user status = %d, want 404", code)
+		}
+	})
+
+	t.Run("unknown session", func(t *testing.T) {
+		if code, _ := post("nope", alice.Token, frame); code != http.StatusNotFound {
+			t.Errorf("POST /events status = %d, want 404", code)
+		}
+	})
+}
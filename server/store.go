@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+)
+
+// Errors returned by every Store implementation.
+var (
+	errNotFound  = errors.New("record not found")
+	errDuplicate = errors.New("duplicate record")
+)
+
+// Store is the persistence layer of the chat server. Handlers only talk to
+// the package-level store, so the server can run on PostgreSQL, SQLite or
+// entirely in memory.
+//
+// Lookups of a single record return errNotFound when it doesn't exist.
+// Records are returned by value; changing them doesn't change the store.
+type Store interface {
+	// Users
+	CreateUser(u *User) error // errDuplicate if the username is taken
+	UserByID(id uint) (User, error)
+	UserByName(username string) (User, error)
+	UsersByID(ids []uint) ([]User, error)
+	UsersByName(usernames []string) ([]User, error)
+	SetLastSeen(userID uint, at time.Time) error
+	SetPasswordHash(userID uint, hash string) error
+
+	// Rooms
+	CreateRoom(room *Room) error // the creator becomes the first member
+	Room(id uint) (Room, error)
+	Rooms() ([]Room, error) // ordered by name
+	RoomMemberIDs(roomID uint) ([]uint, error)
+	UserRoomIDs(userID uint) ([]uint, error)
+	IsRoomMember(roomID, userID uint) (bool, error)
+	AddRoomMember(roomID, userID uint) error
+	RemoveRoomMember(roomID, userID uint) (removed bool, err error)
+	SetRoomSlowMode(roomID uint, seconds int) error
+
+	// Room roles, sanctions, pins and the moderation log
+	RoomMembers(roomID uint) ([]RoomMember, error)                   // in joining order
+	RoomRole(roomID, userID uint) (string, error)                    // errNotFound if not a member
+	SetRoomRole(roomID, userID uint, role string) error              // errNotFound if not a member
+	SetSanction(sanction RoomSanction) error                         // replaces one of the same kind
+	Sanction(roomID, userID uint, kind string) (RoomSanction, error) // expired ones included
+	RemoveSanction(roomID, userID uint, kind string) (removed bool, err error)
+	PinMessage(pin *RoomPin) (added bool, err error)
+	UnpinMessage(roomID, messageID uint) (removed bool, err error)
+	RoomPins(roomID uint) ([]RoomPin, error) // in pinning order
+	// AppendModerationLog records a moderator action. Entries are never
+	// changed or removed.
+	AppendModerationLog(e *ModerationEntry) error
+	// ModerationLog returns up to limit entries of the room's log with IDs
+	// below beforeID when it is set, newest first.
+	ModerationLog(roomID, beforeID uint, limit int) ([]ModerationEntry, error)
+
+	// Messages
+
+	// CreateMessage stores msg, links msg.Attachments to it and adds a
+	// pending receipt for each recipient, all or nothing. It fails with
+	// errInvalidAttachment if an attachment isn't an unsent upload of the
+	// sender.
+	CreateMessage(msg *Message, recipientIDs []uint) error
+	Message(id uint) (Message, error)
+	MessagesByID(ids []uint) ([]Message, error) // ordered by ID
+	// ConversationMessages returns up to limit messages of conv as seen by
+	// userID, older than before when it is set, newest first.
+	ConversationMessages(userID uint, conv conversation, before *pagePos, limit int) ([]Message, error)
+	DirectPeerIDs(userID uint) ([]uint, error)
+	// EditMessage keeps the current content in the edit history and
+	// replaces it. Deleted messages are errNotFound.
+	EditMessage(id uint, content string, at time.Time) error
+	// DeleteMessage tombstones a message, dropping its content, earlier
+	// versions, reactions and attachments. It returns the blob keys of the attachments, which
+	// the caller removes from blob storage. Deleted messages are
+	// errNotFound.
+	DeleteMessage(id uint, at time.Time) (blobKeys []string, err error)
+	MessageEdits(messageID uint) ([]MessageEdit, error) // oldest first
+	SearchMessages(q searchQuery) ([]searchHit, error)
+
+	// Receipts and offline delivery
+
+	// MarkReceipts sets the delivered or read time of the user's receipts
+	// for messageIDs and returns the IDs that changed. Reading a message
+	// also delivers it.
+	MarkReceipts(userID uint, messageIDs []uint, state string, at time.Time) ([]uint, error)
+	ReceiptCounts(messageIDs []uint) ([]receiptCount, error)
+	ReceiptUserIDs(messageID uint) ([]uint, error)
+	// ReceiptsAfter lists, in order, the IDs of messages addressed to
+	// userID newer than afterID; limit 0 means no limit.
+	ReceiptsAfter(userID, afterID uint, limit int) ([]uint, error)
+	LatestReceiptID(userID uint) (uint, error) // 0 if there are none
+	DeviceCursor(userID uint, device string) (DeviceCursor, error)
+	StartDevice(cursor DeviceCursor) error // no-op if the device is known
+	// AdvanceDeviceCursor moves the cursor forward across the receipts
+	// after it that are in messageIDs, stopping at the first that isn't, so
+	// a message the device hasn't acknowledged is flushed to it again. It
+	// never moves backwards.
+	AdvanceDeviceCursor(userID uint, device string, messageIDs []uint, at time.Time) error
+
+	// Refresh tokens
+	CreateRefreshToken(t *RefreshToken) error
+	RefreshTokenByHash(hash string) (RefreshToken, error)
+	// UseRefreshToken marks a token used unless it already was, reporting
+	// whether this call did it.
+	UseRefreshToken(id uint, at time.Time) (bool, error)
+	RevokeFamily(family string, at time.Time) error
+	FamilyRevoked(family string) (bool, error)
+
+	// Reactions, threads and mentions
+	AddReaction(r *Reaction) (added bool, err error)
+	RemoveReaction(r Reaction) (removed bool, err error)
+	Reactions(messageIDs []uint) ([]Reaction, error)    // oldest first
+	ReplyCounts(parentIDs []uint) (map[uint]int, error) // live replies only
+	LatestReplies(parentIDs []uint) ([]Message, error)  // newest live reply per thread
+	CreateMention(m *Mention) (created bool, err error) // false if already recorded
+	Mentions(userID uint, unreadOnly bool, limit int) ([]Mention, error)
+	UnreadMentions(userID uint) (int64, error)
+	MarkMentionsRead(userID uint, ids []uint, at time.Time) error // all when ids is empty
+
+	// Attachments
+	CreateAttachment(a *Attachment) error
+	Attachment(id uint) (Attachment, error)
+	// PendingAttachments loads those of ids the user uploaded and hasn't
+	// sent yet.
+	PendingAttachments(uploaderID uint, ids []uint) ([]Attachment, error)
+	MessageAttachments(messageIDs []uint) ([]Attachment, error)
+
+	Close() error
+}
+
+// pagePos is a position in a message timeline, as carried by pagination
+// cursors.
+type pagePos struct {
+	Timestamp time.Time
+	ID        uint
+}
+
+type receiptCount struct {
+	MessageID uint
+	Total     int
+	Delivered int
+	Read      int
+}
+
+// searchQuery selects live messages visible to UserID that match Text.
+type searchQuery struct {
+	UserID   uint
+	Text     string
+	RoomID   uint       // optional
+	SenderID uint       // optional
+	Since    *time.Time // optional; only messages sent at or after it
+	Before   *pagePos
+	Limit    int
+}
+
+// searchHit is a matching message with a fragment of its content in which
+// matches are wrapped in snippetStart and snippetStop.
+type searchHit struct {
+	Message Message
+	Snippet string
+}
+
+// openStore opens the store selected by driver: "postgres" (the default),
+// "sqlite" or "memory". dsn is the connection string or SQLite file and is
+// ignored by the memory store.
+func openStore(driver, dsn string) (Store, error) {
+	switch driver {
+	case "", "postgres":
+		return newGormStore(postgres.Open(dsn))
+	case "sqlite":
+		return newGormStore(sqlite.Open(dsn))
+	case "memory":
+		return newMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown store driver %q", driver)
+	}
+}
@@ -0,0 +1,704 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// gormStore keeps everything in a SQL database through GORM. It backs both
+// the PostgreSQL and the SQLite driver; only search differs between them.
+type gormStore struct {
+	db *gorm.DB
+}
+
+func newGormStore(dialector gorm.Dialector) (*gormStore, error) {
+	db, err := gorm.Open(dialector, &gorm.Config{TranslateError: true})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &gormStore{db: db}
+	if err := s.migrate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *gormStore) migrate() error {
+	err := s.db.AutoMigrate(&User{}, &Message{}, &Room{}, &RoomMember{}, &RefreshToken{}, &MessageReceipt{}, &DeviceCursor{}, &MessageEdit{}, &Reaction{}, &Mention{}, &Attachment{}, &RoomSanction{}, &RoomPin{}, &ModerationEntry{})
+	if err != nil {
+		return err
+	}
+	if s.postgres() {
+		return s.db.Exec(`CREATE INDEX IF NOT EXISTS idx_messages_content_fts
+			ON messages USING GIN (to_tsvector('` + searchConfig + `', content))`).Error
+	}
+	return nil
+}
+
+func (s *gormStore) postgres() bool {
+	return s.db.Dialector.Name() == "postgres"
+}
+
+func (s *gormStore) Close() error {
+	sqlDB, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
+
+// dbError maps GORM's errors onto the Store ones.
+func dbError(err error) error {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return errNotFound
+	case errors.Is(err, gorm.ErrDuplicatedKey):
+		return errDuplicate
+	default:
+		return err
+	}
+}
+
+// ================= USERS =================
+
+func (s *gormStore) CreateUser(u *User) error {
+	return dbError(s.db.Create(u).Error)
+}
+
+func (s *gormStore) UserByID(id uint) (User, error) {
+	var u User
+	return u, dbError(s.db.First(&u, id).Error)
+}
+
+func (s *gormStore) UserByName(username string) (User, error) {
+	var u User
+	return u, dbError(s.db.First(&u, "username = ?", username).Error)
+}
+
+func (s *gormStore) UsersByID(ids []uint) ([]User, error) {
+	var users []User
+	if len(ids) == 0 {
+		return users, nil
+	}
+	return users, s.db.Where("id IN ?", ids).Find(&users).Error
+}
+
+func (s *gormStore) UsersByName(usernames []string) ([]User, error) {
+	var users []User
+	if len(usernames) == 0 {
+		return users, nil
+	}
+	return users, s.db.Where("username IN ?", usernames).Find(&users).Error
+}
+
+func (s *gormStore) SetLastSeen(userID uint, at time.Time) error {
+	return s.db.Model(&User{}).Where("id = ?", userID).Update("last_seen", at).Error
+}
+
+func (s *gormStore) SetPasswordHash(userID uint, hash string) error {
+	return s.db.Model(&User{}).Where("id = ?", userID).Update("password_hash", hash).Error
+}
+
+// ================= ROOMS =================
+
+func (s *gormStore) CreateRoom(room *Room) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(room).Error; err != nil {
+			return err
+		}
+		return tx.Create(&RoomMember{RoomID: room.ID, UserID: room.CreatedBy, Role: roleOwner, JoinedAt: room.CreatedAt}).Error
+	})
+}
+
+func (s *gormStore) Room(id uint) (Room, error) {
+	var room Room
+	return room, dbError(s.db.First(&room, id).Error)
+}
+
+func (s *gormStore) Rooms() ([]Room, error) {
+	var rooms []Room
+	return rooms, s.db.Order("name").Find(&rooms).Error
+}
+
+func (s *gormStore) RoomMemberIDs(roomID uint) ([]uint, error) {
+	var ids []uint
+	return ids, s.db.Model(&RoomMember{}).Where("room_id = ?", roomID).Pluck("user_id", &ids).Error
+}
+
+func (s *gormStore) UserRoomIDs(userID uint) ([]uint, error) {
+	var ids []uint
+	return ids, s.db.Model(&RoomMember{}).Where("user_id = ?", userID).Pluck("room_id", &ids).Error
+}
+
+func (s *gormStore) IsRoomMember(roomID, userID uint) (bool, error) {
+	var count int64
+	err := s.db.Model(&RoomMember{}).Where("room_id = ? AND user_id = ?", roomID, userID).Count(&count).Error
+	return count > 0, err
+}
+
+func (s *gormStore) AddRoomMember(roomID, userID uint) error {
+	member := RoomMember{RoomID: roomID, UserID: userID, Role: roleMember, JoinedAt: time.Now()}
+	return s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&member).Error
+}
+
+func (s *gormStore) SetRoomSlowMode(roomID uint, seconds int) error {
+	res := s.db.Model(&Room{}).Where("id = ?", roomID).Update("slow_mode", seconds)
+	if res.Error == nil && res.RowsAffected == 0 {
+		return errNotFound
+	}
+	return res.Error
+}
+
+func (s *gormStore) RemoveRoomMember(roomID, userID uint) (bool, error) {
+	res := s.db.Where("room_id = ? AND user_id = ?", roomID, userID).Delete(&RoomMember{})
+	return res.RowsAffected > 0, res.Error
+}
+
+// ================= MESSAGES =================
+
+func (s *gormStore) CreateMessage(msg *Message, recipientIDs []uint) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Attachments").Create(msg).Error; err != nil {
+			return err
+		}
+
+		if len(msg.Attachments) > 0 {
+			ids := make([]uint, 0, len(msg.Attachments))
+			for _, a := range msg.Attachments {
+				ids = append(ids, a.ID)
+			}
+
+			// The conditional update makes a concurrent send of the same
+			// upload fail.
+			res := tx.Model(&Attachment{}).
+				Where("id IN ? AND uploader_id = ? AND message_id IS NULL", ids, msg.SenderID).
+				Update("message_id", msg.ID)
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected != int64(len(ids)) {
+				return errInvalidAttachment
+			}
+			for i := range msg.Attachments {
+				msg.Attachments[i].MessageID = &msg.ID
+			}
+		}
+
+		if len(recipientIDs) == 0 {
+			return nil
+		}
+		receipts := make([]MessageReceipt, 0, len(recipientIDs))
+		for _, id := range recipientIDs {
+			receipts = append(receipts, MessageReceipt{MessageID: msg.ID, UserID: id})
+		}
+		return tx.Create(&receipts).Error
+	})
+}
+
+func (s *gormStore) Message(id uint) (Message, error) {
+	var m Message
+	return m, dbError(s.db.First(&m, id).Error)
+}
+
+func (s *gormStore) MessagesByID(ids []uint) ([]Message, error) {
+	var msgs []Message
+	if len(ids) == 0 {
+		return msgs, nil
+	}
+	return msgs, s.db.Where("id IN ?", ids).Order("id").Find(&msgs).Error
+}
+
+// conversationScope restricts a Message query to the given conversation as
+// seen by userID. Thread replies only appear in their thread.
+func conversationScope(userID uint, c conversation) func(*gorm.DB) *gorm.DB {
+	return func(q *gorm.DB) *gorm.DB {
+		if c.ThreadID != 0 {
+			return q.Where("parent_id = ?", c.ThreadID)
+		}
+
+		q = q.Where("parent_id IS NULL")
+		switch {
+		case c.RoomID != 0:
+			return q.Where("room_id = ?", c.RoomID)
+		case c.PeerID != 0:
+			return q.Where("(sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?)",
+				userID, c.PeerID, c.PeerID, userID)
+		default:
+			return q.Where("room_id IS NULL AND receiver_id IS NULL")
+		}
+	}
+}
+
+func (s *gormStore) ConversationMessages(userID uint, conv conversation, before *pagePos, limit int) ([]Message, error) {
+	q := s.db.Scopes(conversationScope(userID, conv))
+	if before != nil {
+		q = q.Where("timestamp < ? OR (timestamp = ? AND id < ?)", before.Timestamp, before.Timestamp, before.ID)
+	}
+
+	var msgs []Message
+	return msgs, q.Order("timestamp DESC").Order("id DESC").Limit(limit).Find(&msgs).Error
+}
+
+func (s *gormStore) DirectPeerIDs(userID uint) ([]uint, error) {
+	var ids []uint
+	err := s.db.Raw(`SELECT DISTINCT CASE WHEN sender_id = ? THEN receiver_id ELSE sender_id END
+		FROM messages
+		WHERE receiver_id IS NOT NULL AND (sender_id = ? OR receiver_id = ?)`,
+		userID, userID, userID).Scan(&ids).Error
+	return ids, err
+}
+
+// liveMessage loads a message that hasn't been deleted.
+func liveMessage(tx *gorm.DB, id uint) (Message, error) {
+	var m Message
+	err := tx.Where("deleted_at IS NULL").First(&m, id).Error
+	return m, dbError(err)
+}
+
+func (s *gormStore) EditMessage(id uint, content string, at time.Time) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		m, err := liveMessage(tx, id)
+		if err != nil {
+			return err
+		}
+
+		edit := MessageEdit{MessageID: m.ID, Content: m.Content, EditedAt: at}
+		if err := tx.Create(&edit).Error; err != nil {
+			return err
+		}
+		return tx.Model(&m).Updates(map[string]interface{}{"content": content, "edited_at": at}).Error
+	})
+}
+
+func (s *gormStore) DeleteMessage(id uint, at time.Time) ([]string, error) {
+	var keys []string
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		m, err := liveMessage(tx, id)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Where("message_id = ?", m.ID).Delete(&MessageEdit{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("message_id = ?", m.ID).Delete(&Reaction{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&Attachment{}).Where("message_id = ?", m.ID).Pluck("key", &keys).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("message_id = ?", m.ID).Delete(&Attachment{}).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&m).Updates(map[string]interface{}{"content": "", "deleted_at": at}).Error
+	})
+	return keys, err
+}
+
+func (s *gormStore) MessageEdits(messageID uint) ([]MessageEdit, error) {
+	var edits []MessageEdit
+	return edits, s.db.Where("message_id = ?", messageID).Order("edited_at").Find(&edits).Error
+}
+
+// visibleScope restricts a Message query to what userID may read: the
+// lobby, rooms they belong to and their own direct messages.
+func (s *gormStore) visibleScope(userID uint) func(*gorm.DB) *gorm.DB {
+	return func(q *gorm.DB) *gorm.DB {
+		return q.Where(`(messages.room_id IS NULL AND messages.receiver_id IS NULL)
+			OR messages.room_id IN (?)
+			OR (messages.receiver_id IS NOT NULL AND (messages.sender_id = ? OR messages.receiver_id = ?))`,
+			s.db.Model(&RoomMember{}).Select("room_id").Where("user_id = ?", userID),
+			userID, userID)
+	}
+}
+
+// SearchMessages uses PostgreSQL full-text search, or plain substring
+// matching of every query term on SQLite.
+func (s *gormStore) SearchMessages(sq searchQuery) ([]searchHit, error) {
+	q := s.db.Model(&Message{}).
+		Scopes(s.visibleScope(sq.UserID)).
+		Where("messages.deleted_at IS NULL")
+
+	terms := searchTerms(sq.Text)
+	if s.postgres() {
+		tsQuery := "websearch_to_tsquery('" + searchConfig + "', ?)"
+		// Marker bytes in content are dropped so only matches get marked.
+		headline := "ts_headline('" + searchConfig + "', translate(messages.content, chr(1) || chr(2), ''), " + tsQuery + ", ?)"
+		q = q.Select("messages.*, "+headline+" AS snippet",
+			sq.Text, "StartSel="+snippetStart+", StopSel="+snippetStop+", MaxFragments=2, MaxWords=20, MinWords=5").
+			Where("to_tsvector('"+searchConfig+"', messages.content) @@ "+tsQuery, sq.Text)
+	} else {
+		if len(terms) == 0 {
+			return nil, nil
+		}
+		for _, term := range terms {
+			q = q.Where("LOWER(messages.content) LIKE ? ESCAPE '\\'", "%"+escapeLike(term)+"%")
+		}
+	}
+
+	if sq.RoomID != 0 {
+		q = q.Where("messages.room_id = ?", sq.RoomID)
+	}
+	if sq.SenderID != 0 {
+		q = q.Where("messages.sender_id = ?", sq.SenderID)
+	}
+	if sq.Since != nil {
+		q = q.Where("messages.timestamp >= ?", *sq.Since)
+	}
+	if sq.Before != nil {
+		q = q.Where("messages.timestamp < ? OR (messages.timestamp = ? AND messages.id < ?)",
+			sq.Before.Timestamp, sq.Before.Timestamp, sq.Before.ID)
+	}
+
+	var rows []struct {
+		Message
+		Snippet string
+	}
+	err := q.Order("messages.timestamp DESC").Order("messages.id DESC").Limit(sq.Limit).Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	hits := make([]searchHit, 0, len(rows))
+	for _, row := range rows {
+		snippet := row.Snippet
+		if !s.postgres() {
+			snippet = markTerms(row.Content, terms)
+		}
+		hits = append(hits, searchHit{Message: row.Message, Snippet: snippet})
+	}
+	return hits, nil
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// ================= RECEIPTS =================
+
+func (s *gormStore) MarkReceipts(userID uint, messageIDs []uint, state string, at time.Time) ([]uint, error) {
+	column := "delivered_at"
+	if state == receiptRead {
+		column = "read_at"
+	}
+
+	var pending []uint
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&MessageReceipt{}).
+			Where("user_id = ? AND message_id IN ? AND "+column+" IS NULL", userID, messageIDs).
+			Pluck("message_id", &pending).Error
+		if err != nil || len(pending) == 0 {
+			return err
+		}
+
+		updates := map[string]interface{}{column: at}
+		if state == receiptRead {
+			updates["delivered_at"] = gorm.Expr("COALESCE(delivered_at, ?)", at)
+		}
+		return tx.Model(&MessageReceipt{}).
+			Where("user_id = ? AND message_id IN ?", userID, pending).
+			Updates(updates).Error
+	})
+	return pending, err
+}
+
+func (s *gormStore) ReceiptCounts(messageIDs []uint) ([]receiptCount, error) {
+	var rows []receiptCount
+	if len(messageIDs) == 0 {
+		return rows, nil
+	}
+	err := s.db.Model(&MessageReceipt{}).
+		Select("message_id, COUNT(*) AS total, COUNT(delivered_at) AS delivered, COUNT(read_at) AS read").
+		Where("message_id IN ?", messageIDs).
+		Group("message_id").
+		Scan(&rows).Error
+	return rows, err
+}
+
+func (s *gormStore) ReceiptUserIDs(messageID uint) ([]uint, error) {
+	var ids []uint
+	return ids, s.db.Model(&MessageReceipt{}).Where("message_id = ?", messageID).Pluck("user_id", &ids).Error
+}
+
+func (s *gormStore) ReceiptsAfter(userID, afterID uint, limit int) ([]uint, error) {
+	q := s.db.Model(&MessageReceipt{}).
+		Where("user_id = ? AND message_id > ?", userID, afterID).
+		Order("message_id")
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+
+	var ids []uint
+	return ids, q.Pluck("message_id", &ids).Error
+}
+
+func (s *gormStore) LatestReceiptID(userID uint) (uint, error) {
+	var id uint
+	err := s.db.Model(&MessageReceipt{}).
+		Where("user_id = ?", userID).
+		Select("COALESCE(MAX(message_id), 0)").
+		Scan(&id).Error
+	return id, err
+}
+
+func (s *gormStore) DeviceCursor(userID uint, device string) (DeviceCursor, error) {
+	var cursor DeviceCursor
+	return cursor, dbError(s.db.First(&cursor, "user_id = ? AND device = ?", userID, device).Error)
+}
+
+func (s *gormStore) StartDevice(cursor DeviceCursor) error {
+	return s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&cursor).Error
+}
+
+func (s *gormStore) AdvanceDeviceCursor(userID uint, device string, messageIDs []uint, at time.Time) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var cursor DeviceCursor
+		err := tx.First(&cursor, "user_id = ? AND device = ?", userID, device).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// The cursor can move no further than len(messageIDs) receipts.
+		var pending []uint
+		err = tx.Model(&MessageReceipt{}).
+			Where("user_id = ? AND message_id > ?", userID, cursor.LastMessageID).
+			Order("message_id").
+			Limit(len(messageIDs)).
+			Pluck("message_id", &pending).Error
+		if err != nil {
+			return err
+		}
+
+		newest := cursor.LastMessageID
+		for _, id := range pending {
+			if !slices.Contains(messageIDs, id) {
+				break
+			}
+			newest = id
+		}
+		if newest == cursor.LastMessageID {
+			return nil
+		}
+
+		return tx.Model(&DeviceCursor{}).
+			Where("user_id = ? AND device = ? AND last_message_id = ?", userID, device, cursor.LastMessageID).
+			Updates(map[string]interface{}{"last_message_id": newest, "updated_at": at}).Error
+	})
+}
+
+// ================= REFRESH TOKENS =================
+
+func (s *gormStore) CreateRefreshToken(t *RefreshToken) error {
+	return dbError(s.db.Create(t).Error)
+}
+
+func (s *gormStore) RefreshTokenByHash(hash string) (RefreshToken, error) {
+	var t RefreshToken
+	return t, dbError(s.db.First(&t, "token_hash = ?", hash).Error)
+}
+
+func (s *gormStore) UseRefreshToken(id uint, at time.Time) (bool, error) {
+	res := s.db.Model(&RefreshToken{}).
+		Where("id = ? AND used_at IS NULL", id).
+		Update("used_at", at)
+	return res.RowsAffected > 0, res.Error
+}
+
+func (s *gormStore) RevokeFamily(family string, at time.Time) error {
+	return s.db.Model(&RefreshToken{}).
+		Where("family = ? AND revoked_at IS NULL", family).
+		Update("revoked_at", at).Error
+}
+
+func (s *gormStore) FamilyRevoked(family string) (bool, error) {
+	var count int64
+	err := s.db.Model(&RefreshToken{}).Where("family = ? AND revoked_at IS NOT NULL", family).Count(&count).Error
+	return count > 0, err
+}
+
+// ================= REACTIONS, THREADS, MENTIONS =================
+
+func (s *gormStore) AddReaction(r *Reaction) (bool, error) {
+	res := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(r)
+	return res.RowsAffected > 0, res.Error
+}
+
+func (s *gormStore) RemoveReaction(r Reaction) (bool, error) {
+	res := s.db.Where("message_id = ? AND user_id = ? AND emoji = ?", r.MessageID, r.UserID, r.Emoji).Delete(&Reaction{})
+	return res.RowsAffected > 0, res.Error
+}
+
+func (s *gormStore) Reactions(messageIDs []uint) ([]Reaction, error) {
+	var reactions []Reaction
+	if len(messageIDs) == 0 {
+		return reactions, nil
+	}
+	return reactions, s.db.Where("message_id IN ?", messageIDs).Order("created_at").Find(&reactions).Error
+}
+
+func (s *gormStore) ReplyCounts(parentIDs []uint) (map[uint]int, error) {
+	counts := make(map[uint]int)
+	if len(parentIDs) == 0 {
+		return counts, nil
+	}
+
+	var rows []struct {
+		ParentID uint
+		Count    int
+	}
+	err := s.db.Model(&Message{}).
+		Select("parent_id, COUNT(*) AS count").
+		Where("parent_id IN ? AND deleted_at IS NULL", parentIDs).
+		Group("parent_id").
+		Scan(&rows).Error
+	for _, r := range rows {
+		counts[r.ParentID] = r.Count
+	}
+	return counts, err
+}
+
+func (s *gormStore) LatestReplies(parentIDs []uint) ([]Message, error) {
+	var msgs []Message
+	if len(parentIDs) == 0 {
+		return msgs, nil
+	}
+	err := s.db.Where("id IN (?)", s.db.Model(&Message{}).
+		Select("MAX(id)").
+		Where("parent_id IN ? AND deleted_at IS NULL", parentIDs).
+		Group("parent_id")).
+		Find(&msgs).Error
+	return msgs, err
+}
+
+func (s *gormStore) CreateMention(m *Mention) (bool, error) {
+	res := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(m)
+	return res.RowsAffected > 0, res.Error
+}
+
+func (s *gormStore) Mentions(userID uint, unreadOnly bool, limit int) ([]Mention, error) {
+	q := s.db.Where("user_id = ?", userID)
+	if unreadOnly {
+		q = q.Where("read_at IS NULL")
+	}
+
+	var mentions []Mention
+	return mentions, q.Order("id DESC").Limit(limit).Find(&mentions).Error
+}
+
+func (s *gormStore) UnreadMentions(userID uint) (int64, error) {
+	var unread int64
+	err := s.db.Model(&Mention{}).Where("user_id = ? AND read_at IS NULL", userID).Count(&unread).Error
+	return unread, err
+}
+
+func (s *gormStore) MarkMentionsRead(userID uint, ids []uint, at time.Time) error {
+	q := s.db.Model(&Mention{}).Where("user_id = ? AND read_at IS NULL", userID)
+	if len(ids) > 0 {
+		q = q.Where("id IN ?", ids)
+	}
+	return q.Update("read_at", at).Error
+}
+
+// ================= ATTACHMENTS =================
+
+func (s *gormStore) CreateAttachment(a *Attachment) error {
+	return dbError(s.db.Create(a).Error)
+}
+
+func (s *gormStore) Attachment(id uint) (Attachment, error) {
+	var a Attachment
+	return a, dbError(s.db.First(&a, id).Error)
+}
+
+func (s *gormStore) PendingAttachments(uploaderID uint, ids []uint) ([]Attachment, error) {
+	var list []Attachment
+	if len(ids) == 0 {
+		return list, nil
+	}
+	err := s.db.Where("id IN ? AND uploader_id = ? AND message_id IS NULL", ids, uploaderID).Find(&list).Error
+	return list, err
+}
+
+func (s *gormStore) MessageAttachments(messageIDs []uint) ([]Attachment, error) {
+	var list []Attachment
+	if len(messageIDs) == 0 {
+		return list, nil
+	}
+	return list, s.db.Where("message_id IN ?", messageIDs).Order("id").Find(&list).Error
+}
+
+// ================= MODERATION =================
+
+func (s *gormStore) RoomMembers(roomID uint) ([]RoomMember, error) {
+	var members []RoomMember
+	return members, s.db.Where("room_id = ?", roomID).Order("joined_at, user_id").Find(&members).Error
+}
+
+func (s *gormStore) RoomRole(roomID, userID uint) (string, error) {
+	var member RoomMember
+	err := s.db.Where("room_id = ? AND user_id = ?", roomID, userID).First(&member).Error
+	return member.Role, dbError(err)
+}
+
+func (s *gormStore) SetRoomRole(roomID, userID uint, role string) error {
+	res := s.db.Model(&RoomMember{}).Where("room_id = ? AND user_id = ?", roomID, userID).Update("role", role)
+	if res.Error == nil && res.RowsAffected == 0 {
+		return errNotFound
+	}
+	return res.Error
+}
+
+func (s *gormStore) SetSanction(sanction RoomSanction) error {
+	return s.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&sanction).Error
+}
+
+func (s *gormStore) Sanction(roomID, userID uint, kind string) (RoomSanction, error) {
+	var sanction RoomSanction
+	err := s.db.Where("room_id = ? AND user_id = ? AND kind = ?", roomID, userID, kind).First(&sanction).Error
+	return sanction, dbError(err)
+}
+
+func (s *gormStore) RemoveSanction(roomID, userID uint, kind string) (bool, error) {
+	res := s.db.Where("room_id = ? AND user_id = ? AND kind = ?", roomID, userID, kind).Delete(&RoomSanction{})
+	return res.RowsAffected > 0, res.Error
+}
+
+func (s *gormStore) PinMessage(pin *RoomPin) (bool, error) {
+	nowIfZero(&pin.PinnedAt)
+	res := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(pin)
+	return res.RowsAffected > 0, res.Error
+}
+
+func (s *gormStore) UnpinMessage(roomID, messageID uint) (bool, error) {
+	res := s.db.Where("room_id = ? AND message_id = ?", roomID, messageID).Delete(&RoomPin{})
+	return res.RowsAffected > 0, res.Error
+}
+
+func (s *gormStore) RoomPins(roomID uint) ([]RoomPin, error) {
+	var pins []RoomPin
+	return pins, s.db.Where("room_id = ?", roomID).Order("pinned_at, message_id").Find(&pins).Error
+}
+
+func (s *gormStore) AppendModerationLog(e *ModerationEntry) error {
+	return s.db.Create(e).Error
+}
+
+func (s *gormStore) ModerationLog(roomID, beforeID uint, limit int) ([]ModerationEntry, error) {
+	q := s.db.Where("room_id = ?", roomID)
+	if beforeID != 0 {
+		q = q.Where("id < ?", beforeID)
+	}
+
+	var entries []ModerationEntry
+	return entries, q.Order("id DESC").Limit(limit).Find(&entries).Error
+}
@@ -0,0 +1,1077 @@
+package main
+
+import (
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps everything in process memory. Nothing survives a
+// restart, so it is meant for tests and for trying the server out without a
+// database. IDs are assigned in insertion order, starting at 1.
+type memoryStore struct {
+	mu sync.Mutex
+
+	users    []User                       // ID is index+1
+	rooms    []Room                       // ID is index+1
+	messages []Message                    // ID is index+1
+	members  map[uint]map[uint]RoomMember // room ID -> user ID
+	receipts map[uint]map[uint]*MessageReceipt
+	cursors  map[deviceKey]DeviceCursor
+
+	tokens      []RefreshToken // ID is index+1
+	edits       []MessageEdit
+	reactions   []Reaction // in creation order
+	mentions    []Mention  // ID is index+1
+	attachments map[uint]Attachment
+	nextAttach  uint
+
+	sanctions map[sanctionKey]RoomSanction
+	pins      []RoomPin         // in pinning order
+	modLog    []ModerationEntry // ID is index+1
+}
+
+type sanctionKey struct {
+	RoomID uint
+	UserID uint
+	Kind   string
+}
+
+type deviceKey struct {
+	UserID uint
+	Device string
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		members:     make(map[uint]map[uint]RoomMember),
+		receipts:    make(map[uint]map[uint]*MessageReceipt),
+		cursors:     make(map[deviceKey]DeviceCursor),
+		attachments: make(map[uint]Attachment),
+		sanctions:   make(map[sanctionKey]RoomSanction),
+	}
+}
+
+func (s *memoryStore) Close() error { return nil }
+
+func cloneUint(p *uint) *uint {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	return &v
+}
+
+func cloneTime(p *time.Time) *time.Time {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	return &v
+}
+
+func nowIfZero(t *time.Time) {
+	if t.IsZero() {
+		*t = time.Now()
+	}
+}
+
+// ================= USERS =================
+
+func (s *memoryStore) CreateUser(u *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.users {
+		if existing.Username == u.Username {
+			return errDuplicate
+		}
+	}
+
+	u.ID = uint(len(s.users) + 1)
+	nowIfZero(&u.CreatedAt)
+	s.users = append(s.users, *u)
+	return nil
+}
+
+// user returns a pointer into s.users, or nil. s.mu must be held.
+func (s *memoryStore) user(id uint) *User {
+	if id == 0 || int(id) > len(s.users) {
+		return nil
+	}
+	return &s.users[id-1]
+}
+
+func (s *memoryStore) UserByID(id uint) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u := s.user(id); u != nil {
+		return *u, nil
+	}
+	return User{}, errNotFound
+}
+
+func (s *memoryStore) UserByName(username string) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.users {
+		if u.Username == username {
+			return u, nil
+		}
+	}
+	return User{}, errNotFound
+}
+
+func (s *memoryStore) UsersByID(ids []uint) ([]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var users []User
+	for _, u := range s.users {
+		if slices.Contains(ids, u.ID) {
+			users = append(users, u)
+		}
+	}
+	return users, nil
+}
+
+func (s *memoryStore) UsersByName(usernames []string) ([]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var users []User
+	for _, u := range s.users {
+		if slices.Contains(usernames, u.Username) {
+			users = append(users, u)
+		}
+	}
+	return users, nil
+}
+
+func (s *memoryStore) SetLastSeen(userID uint, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u := s.user(userID); u != nil {
+		u.LastSeen = &at
+	}
+	return nil
+}
+
+func (s *memoryStore) SetPasswordHash(userID uint, hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u := s.user(userID); u != nil {
+		u.PasswordHash = hash
+	}
+	return nil
+}
+
+// ================= ROOMS =================
+
+func (s *memoryStore) CreateRoom(room *Room) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	room.ID = uint(len(s.rooms) + 1)
+	nowIfZero(&room.CreatedAt)
+	s.rooms = append(s.rooms, *room)
+	s.members[room.ID] = map[uint]RoomMember{
+		room.CreatedBy: {RoomID: room.ID, UserID: room.CreatedBy, Role: roleOwner, JoinedAt: room.CreatedAt},
+	}
+	return nil
+}
+
+func (s *memoryStore) Room(id uint) (Room, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id == 0 || int(id) > len(s.rooms) {
+		return Room{}, errNotFound
+	}
+	return s.rooms[id-1], nil
+}
+
+func (s *memoryStore) Rooms() ([]Room, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rooms := slices.Clone(s.rooms)
+	sort.SliceStable(rooms, func(i, j int) bool { return rooms[i].Name < rooms[j].Name })
+	return rooms, nil
+}
+
+func (s *memoryStore) RoomMemberIDs(roomID uint) ([]uint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ids []uint
+	for id := range s.members[roomID] {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (s *memoryStore) UserRoomIDs(userID uint) ([]uint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ids []uint
+	for roomID, members := range s.members {
+		if _, ok := members[userID]; ok {
+			ids = append(ids, roomID)
+		}
+	}
+	return ids, nil
+}
+
+func (s *memoryStore) IsRoomMember(roomID, userID uint) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.members[roomID][userID]
+	return ok, nil
+}
+
+func (s *memoryStore) AddRoomMember(roomID, userID uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	members := s.members[roomID]
+	if members == nil {
+		members = make(map[uint]RoomMember)
+		s.members[roomID] = members
+	}
+	if _, ok := members[userID]; !ok {
+		members[userID] = RoomMember{RoomID: roomID, UserID: userID, Role: roleMember, JoinedAt: time.Now()}
+	}
+	return nil
+}
+
+func (s *memoryStore) SetRoomSlowMode(roomID uint, seconds int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if roomID == 0 || int(roomID) > len(s.rooms) {
+		return errNotFound
+	}
+	s.rooms[roomID-1].SlowMode = seconds
+	return nil
+}
+
+func (s *memoryStore) RemoveRoomMember(roomID, userID uint) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.members[roomID][userID]; !ok {
+		return false, nil
+	}
+	delete(s.members[roomID], userID)
+	return true, nil
+}
+
+// ================= MESSAGES =================
+
+func (s *memoryStore) CreateMessage(msg *Message, recipientIDs []uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := uint(len(s.messages) + 1)
+	for _, a := range msg.Attachments {
+		stored, ok := s.attachments[a.ID]
+		if !ok || stored.UploaderID != msg.SenderID || stored.MessageID != nil {
+			return errInvalidAttachment
+		}
+	}
+	for i, a := range msg.Attachments {
+		stored := s.attachments[a.ID]
+		stored.MessageID = &id
+		s.attachments[a.ID] = stored
+		msg.Attachments[i].MessageID = &id
+	}
+
+	msg.ID = id
+	stored := *msg
+	stored.ReceiverID = cloneUint(msg.ReceiverID)
+	stored.RoomID = cloneUint(msg.RoomID)
+	stored.ParentID = cloneUint(msg.ParentID)
+	stored.Attachments = nil
+	s.messages = append(s.messages, stored)
+
+	if len(recipientIDs) > 0 {
+		receipts := make(map[uint]*MessageReceipt, len(recipientIDs))
+		for _, userID := range recipientIDs {
+			receipts[userID] = &MessageReceipt{MessageID: id, UserID: userID}
+		}
+		s.receipts[id] = receipts
+	}
+	return nil
+}
+
+// message returns a pointer into s.messages, or nil. s.mu must be held.
+func (s *memoryStore) message(id uint) *Message {
+	if id == 0 || int(id) > len(s.messages) {
+		return nil
+	}
+	return &s.messages[id-1]
+}
+
+func (s *memoryStore) Message(id uint) (Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if m := s.message(id); m != nil {
+		return *m, nil
+	}
+	return Message{}, errNotFound
+}
+
+func (s *memoryStore) MessagesByID(ids []uint) ([]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sorted := slices.Clone(ids)
+	slices.Sort(sorted)
+
+	var msgs []Message
+	for _, id := range slices.Compact(sorted) {
+		if m := s.message(id); m != nil {
+			msgs = append(msgs, *m)
+		}
+	}
+	return msgs, nil
+}
+
+// includes mirrors conversationScope for the memory store.
+func (c conversation) includes(userID uint, m Message) bool {
+	if c.ThreadID != 0 {
+		return m.ParentID != nil && *m.ParentID == c.ThreadID
+	}
+	if m.ParentID != nil {
+		return false
+	}
+
+	switch {
+	case c.RoomID != 0:
+		return m.RoomID != nil && *m.RoomID == c.RoomID
+	case c.PeerID != 0:
+		return m.ReceiverID != nil &&
+			((m.SenderID == userID && *m.ReceiverID == c.PeerID) ||
+				(m.SenderID == c.PeerID && *m.ReceiverID == userID))
+	default:
+		return m.RoomID == nil && m.ReceiverID == nil
+	}
+}
+
+// older reports whether m sorts before pos in timeline order.
+func (pos pagePos) older(m Message) bool {
+	return m.Timestamp.Before(pos.Timestamp) || (m.Timestamp.Equal(pos.Timestamp) && m.ID < pos.ID)
+}
+
+// newestFirst sorts msgs the way the SQL stores order a timeline page.
+func newestFirst(msgs []Message) {
+	sort.Slice(msgs, func(i, j int) bool {
+		if !msgs[i].Timestamp.Equal(msgs[j].Timestamp) {
+			return msgs[i].Timestamp.After(msgs[j].Timestamp)
+		}
+		return msgs[i].ID > msgs[j].ID
+	})
+}
+
+func (s *memoryStore) ConversationMessages(userID uint, conv conversation, before *pagePos, limit int) ([]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var msgs []Message
+	for _, m := range s.messages {
+		if conv.includes(userID, m) && (before == nil || before.older(m)) {
+			msgs = append(msgs, m)
+		}
+	}
+
+	newestFirst(msgs)
+	if len(msgs) > limit {
+		msgs = msgs[:limit]
+	}
+	return msgs, nil
+}
+
+func (s *memoryStore) DirectPeerIDs(userID uint) ([]uint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ids []uint
+	for _, m := range s.messages {
+		if m.ReceiverID == nil {
+			continue
+		}
+
+		peer := uint(0)
+		switch {
+		case m.SenderID == userID:
+			peer = *m.ReceiverID
+		case *m.ReceiverID == userID:
+			peer = m.SenderID
+		}
+		if peer != 0 && !slices.Contains(ids, peer) {
+			ids = append(ids, peer)
+		}
+	}
+	return ids, nil
+}
+
+func (s *memoryStore) EditMessage(id uint, content string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := s.message(id)
+	if m == nil || m.DeletedAt != nil {
+		return errNotFound
+	}
+
+	s.edits = append(s.edits, MessageEdit{
+		ID:        uint(len(s.edits) + 1),
+		MessageID: id,
+		Content:   m.Content,
+		EditedAt:  at,
+	})
+	m.Content = content
+	m.EditedAt = &at
+	return nil
+}
+
+func (s *memoryStore) DeleteMessage(id uint, at time.Time) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := s.message(id)
+	if m == nil || m.DeletedAt != nil {
+		return nil, errNotFound
+	}
+
+	s.edits = slices.DeleteFunc(s.edits, func(e MessageEdit) bool { return e.MessageID == id })
+	s.reactions = slices.DeleteFunc(s.reactions, func(r Reaction) bool { return r.MessageID == id })
+
+	var keys []string
+	for attachmentID, a := range s.attachments {
+		if a.MessageID != nil && *a.MessageID == id {
+			keys = append(keys, a.Key)
+			delete(s.attachments, attachmentID)
+		}
+	}
+
+	m.Content = ""
+	m.DeletedAt = &at
+	return keys, nil
+}
+
+func (s *memoryStore) MessageEdits(messageID uint) ([]MessageEdit, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var edits []MessageEdit
+	for _, e := range s.edits {
+		if e.MessageID == messageID {
+			edits = append(edits, e)
+		}
+	}
+	return edits, nil
+}
+
+// visible mirrors canViewMessage. s.mu must be held.
+func (s *memoryStore) visible(userID uint, m Message) bool {
+	switch {
+	case m.RoomID != nil:
+		_, ok := s.members[*m.RoomID][userID]
+		return ok
+	case m.ReceiverID != nil:
+		return m.SenderID == userID || *m.ReceiverID == userID
+	default:
+		return true
+	}
+}
+
+// SearchMessages matches messages containing every query term, ignoring
+// case.
+func (s *memoryStore) SearchMessages(q searchQuery) ([]searchHit, error) {
+	terms := searchTerms(q.Text)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var msgs []Message
+	for _, m := range s.messages {
+		switch {
+		case m.DeletedAt != nil || !s.visible(q.UserID, m):
+		case q.RoomID != 0 && (m.RoomID == nil || *m.RoomID != q.RoomID):
+		case q.SenderID != 0 && m.SenderID != q.SenderID:
+		case q.Since != nil && m.Timestamp.Before(*q.Since):
+		case q.Before != nil && !q.Before.older(m):
+		default:
+			content := strings.ToLower(m.Content)
+			if !slices.ContainsFunc(terms, func(t string) bool { return !strings.Contains(content, t) }) {
+				msgs = append(msgs, m)
+			}
+		}
+	}
+
+	newestFirst(msgs)
+	if len(msgs) > q.Limit {
+		msgs = msgs[:q.Limit]
+	}
+
+	hits := make([]searchHit, 0, len(msgs))
+	for _, m := range msgs {
+		hits = append(hits, searchHit{Message: m, Snippet: markTerms(m.Content, terms)})
+	}
+	return hits, nil
+}
+
+// ================= RECEIPTS =================
+
+func (s *memoryStore) MarkReceipts(userID uint, messageIDs []uint, state string, at time.Time) ([]uint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var changed []uint
+	for _, id := range messageIDs {
+		r := s.receipts[id][userID]
+		switch {
+		case r == nil:
+		case state == receiptRead && r.ReadAt == nil:
+			r.ReadAt = &at
+			if r.DeliveredAt == nil {
+				r.DeliveredAt = &at
+			}
+			changed = append(changed, id)
+		case state == receiptDelivered && r.DeliveredAt == nil:
+			r.DeliveredAt = &at
+			changed = append(changed, id)
+		}
+	}
+	return changed, nil
+}
+
+func (s *memoryStore) ReceiptCounts(messageIDs []uint) ([]receiptCount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var rows []receiptCount
+	for _, id := range messageIDs {
+		receipts := s.receipts[id]
+		if len(receipts) == 0 {
+			continue
+		}
+
+		row := receiptCount{MessageID: id, Total: len(receipts)}
+		for _, r := range receipts {
+			if r.DeliveredAt != nil {
+				row.Delivered++
+			}
+			if r.ReadAt != nil {
+				row.Read++
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func (s *memoryStore) ReceiptUserIDs(messageID uint) ([]uint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ids []uint
+	for id := range s.receipts[messageID] {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (s *memoryStore) ReceiptsAfter(userID, afterID uint, limit int) ([]uint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ids []uint
+	for id := afterID + 1; int(id) <= len(s.messages); id++ {
+		if s.receipts[id][userID] == nil {
+			continue
+		}
+		ids = append(ids, id)
+		if len(ids) == limit {
+			break
+		}
+	}
+	return ids, nil
+}
+
+func (s *memoryStore) LatestReceiptID(userID uint) (uint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id := uint(len(s.messages)); id > 0; id-- {
+		if s.receipts[id][userID] != nil {
+			return id, nil
+		}
+	}
+	return 0, nil
+}
+
+func (s *memoryStore) DeviceCursor(userID uint, device string) (DeviceCursor, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cursor, ok := s.cursors[deviceKey{userID, device}]
+	if !ok {
+		return cursor, errNotFound
+	}
+	return cursor, nil
+}
+
+func (s *memoryStore) StartDevice(cursor DeviceCursor) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := deviceKey{cursor.UserID, cursor.Device}
+	if _, ok := s.cursors[key]; !ok {
+		nowIfZero(&cursor.UpdatedAt)
+		s.cursors[key] = cursor
+	}
+	return nil
+}
+
+func (s *memoryStore) AdvanceDeviceCursor(userID uint, device string, messageIDs []uint, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := deviceKey{userID, device}
+	cursor, ok := s.cursors[key]
+	if !ok {
+		return nil
+	}
+
+	newest := cursor.LastMessageID
+	for id := newest + 1; int(id) <= len(s.messages); id++ {
+		if s.receipts[id][userID] == nil {
+			continue
+		}
+		if !slices.Contains(messageIDs, id) {
+			break
+		}
+		newest = id
+	}
+
+	if newest > cursor.LastMessageID {
+		cursor.LastMessageID = newest
+		cursor.UpdatedAt = at
+		s.cursors[key] = cursor
+	}
+	return nil
+}
+
+// ================= REFRESH TOKENS =================
+
+func (s *memoryStore) CreateRefreshToken(t *RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.tokens {
+		if existing.TokenHash == t.TokenHash {
+			return errDuplicate
+		}
+	}
+
+	t.ID = uint(len(s.tokens) + 1)
+	nowIfZero(&t.CreatedAt)
+	s.tokens = append(s.tokens, *t)
+	return nil
+}
+
+func (s *memoryStore) RefreshTokenByHash(hash string) (RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, t := range s.tokens {
+		if t.TokenHash == hash {
+			return t, nil
+		}
+	}
+	return RefreshToken{}, errNotFound
+}
+
+func (s *memoryStore) UseRefreshToken(id uint, at time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id == 0 || int(id) > len(s.tokens) || s.tokens[id-1].UsedAt != nil {
+		return false, nil
+	}
+	s.tokens[id-1].UsedAt = &at
+	return true, nil
+}
+
+func (s *memoryStore) RevokeFamily(family string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.tokens {
+		if s.tokens[i].Family == family && s.tokens[i].RevokedAt == nil {
+			s.tokens[i].RevokedAt = &at
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) FamilyRevoked(family string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, t := range s.tokens {
+		if t.Family == family && t.RevokedAt != nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ================= REACTIONS, THREADS, MENTIONS =================
+
+func (s *memoryStore) AddReaction(r *Reaction) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.reactions {
+		if existing.MessageID == r.MessageID && existing.UserID == r.UserID && existing.Emoji == r.Emoji {
+			return false, nil
+		}
+	}
+
+	nowIfZero(&r.CreatedAt)
+	s.reactions = append(s.reactions, *r)
+	return true, nil
+}
+
+func (s *memoryStore) RemoveReaction(r Reaction) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	before := len(s.reactions)
+	s.reactions = slices.DeleteFunc(s.reactions, func(existing Reaction) bool {
+		return existing.MessageID == r.MessageID && existing.UserID == r.UserID && existing.Emoji == r.Emoji
+	})
+	return len(s.reactions) < before, nil
+}
+
+func (s *memoryStore) Reactions(messageIDs []uint) ([]Reaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var reactions []Reaction
+	for _, r := range s.reactions {
+		if slices.Contains(messageIDs, r.MessageID) {
+			reactions = append(reactions, r)
+		}
+	}
+	return reactions, nil
+}
+
+func (s *memoryStore) ReplyCounts(parentIDs []uint) (map[uint]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := make(map[uint]int)
+	for _, m := range s.messages {
+		if m.ParentID != nil && m.DeletedAt == nil && slices.Contains(parentIDs, *m.ParentID) {
+			counts[*m.ParentID]++
+		}
+	}
+	return counts, nil
+}
+
+func (s *memoryStore) LatestReplies(parentIDs []uint) ([]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	latest := make(map[uint]Message)
+	for _, m := range s.messages {
+		if m.ParentID != nil && m.DeletedAt == nil && slices.Contains(parentIDs, *m.ParentID) {
+			latest[*m.ParentID] = m
+		}
+	}
+
+	msgs := make([]Message, 0, len(latest))
+	for _, m := range latest {
+		msgs = append(msgs, m)
+	}
+	return msgs, nil
+}
+
+func (s *memoryStore) CreateMention(m *Mention) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.mentions {
+		if existing.MessageID == m.MessageID && existing.UserID == m.UserID {
+			return false, nil
+		}
+	}
+
+	m.ID = uint(len(s.mentions) + 1)
+	nowIfZero(&m.CreatedAt)
+	s.mentions = append(s.mentions, *m)
+	return true, nil
+}
+
+func (s *memoryStore) Mentions(userID uint, unreadOnly bool, limit int) ([]Mention, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var mentions []Mention
+	for i := len(s.mentions) - 1; i >= 0 && len(mentions) < limit; i-- {
+		m := s.mentions[i]
+		if m.UserID == userID && (!unreadOnly || m.ReadAt == nil) {
+			mentions = append(mentions, m)
+		}
+	}
+	return mentions, nil
+}
+
+func (s *memoryStore) UnreadMentions(userID uint) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var unread int64
+	for _, m := range s.mentions {
+		if m.UserID == userID && m.ReadAt == nil {
+			unread++
+		}
+	}
+	return unread, nil
+}
+
+func (s *memoryStore) MarkMentionsRead(userID uint, ids []uint, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.mentions {
+		m := &s.mentions[i]
+		if m.UserID == userID && m.ReadAt == nil && (len(ids) == 0 || slices.Contains(ids, m.ID)) {
+			m.ReadAt = &at
+		}
+	}
+	return nil
+}
+
+// ================= ATTACHMENTS =================
+
+func (s *memoryStore) CreateAttachment(a *Attachment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.attachments {
+		if existing.Key == a.Key {
+			return errDuplicate
+		}
+	}
+
+	s.nextAttach++
+	a.ID = s.nextAttach
+	nowIfZero(&a.CreatedAt)
+	s.attachments[a.ID] = *a
+	return nil
+}
+
+func (s *memoryStore) Attachment(id uint) (Attachment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.attachments[id]
+	if !ok {
+		return a, errNotFound
+	}
+	return a, nil
+}
+
+func (s *memoryStore) PendingAttachments(uploaderID uint, ids []uint) ([]Attachment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sorted := slices.Clone(ids)
+	slices.Sort(sorted)
+
+	var list []Attachment
+	for _, id := range slices.Compact(sorted) {
+		a, ok := s.attachments[id]
+		if ok && a.UploaderID == uploaderID && a.MessageID == nil {
+			list = append(list, a)
+		}
+	}
+	return list, nil
+}
+
+func (s *memoryStore) MessageAttachments(messageIDs []uint) ([]Attachment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var list []Attachment
+	for _, a := range s.attachments {
+		if a.MessageID != nil && slices.Contains(messageIDs, *a.MessageID) {
+			list = append(list, a)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, nil
+}
+
+// ================= MODERATION =================
+
+func (s *memoryStore) RoomMembers(roomID uint) ([]RoomMember, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	members := make([]RoomMember, 0, len(s.members[roomID]))
+	for _, m := range s.members[roomID] {
+		members = append(members, m)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if !members[i].JoinedAt.Equal(members[j].JoinedAt) {
+			return members[i].JoinedAt.Before(members[j].JoinedAt)
+		}
+		return members[i].UserID < members[j].UserID
+	})
+	return members, nil
+}
+
+func (s *memoryStore) RoomRole(roomID, userID uint) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.members[roomID][userID]
+	if !ok {
+		return "", errNotFound
+	}
+	return m.Role, nil
+}
+
+func (s *memoryStore) SetRoomRole(roomID, userID uint, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.members[roomID][userID]
+	if !ok {
+		return errNotFound
+	}
+	m.Role = role
+	s.members[roomID][userID] = m
+	return nil
+}
+
+func (s *memoryStore) SetSanction(sanction RoomSanction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nowIfZero(&sanction.CreatedAt)
+	sanction.ExpiresAt = cloneTime(sanction.ExpiresAt)
+	s.sanctions[sanctionKey{sanction.RoomID, sanction.UserID, sanction.Kind}] = sanction
+	return nil
+}
+
+func (s *memoryStore) Sanction(roomID, userID uint, kind string) (RoomSanction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sanction, ok := s.sanctions[sanctionKey{roomID, userID, kind}]
+	if !ok {
+		return RoomSanction{}, errNotFound
+	}
+	sanction.ExpiresAt = cloneTime(sanction.ExpiresAt)
+	return sanction, nil
+}
+
+func (s *memoryStore) RemoveSanction(roomID, userID uint, kind string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := sanctionKey{roomID, userID, kind}
+	if _, ok := s.sanctions[key]; !ok {
+		return false, nil
+	}
+	delete(s.sanctions, key)
+	return true, nil
+}
+
+func (s *memoryStore) PinMessage(pin *RoomPin) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, p := range s.pins {
+		if p.RoomID == pin.RoomID && p.MessageID == pin.MessageID {
+			return false, nil
+		}
+	}
+	nowIfZero(&pin.PinnedAt)
+	s.pins = append(s.pins, *pin)
+	return true, nil
+}
+
+func (s *memoryStore) UnpinMessage(roomID, messageID uint) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, p := range s.pins {
+		if p.RoomID == roomID && p.MessageID == messageID {
+			s.pins = slices.Delete(s.pins, i, i+1)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStore) RoomPins(roomID uint) ([]RoomPin, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var pins []RoomPin
+	for _, p := range s.pins {
+		if p.RoomID == roomID {
+			pins = append(pins, p)
+		}
+	}
+	return pins, nil
+}
+
+func (s *memoryStore) AppendModerationLog(e *ModerationEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e.ID = uint(len(s.modLog) + 1)
+	nowIfZero(&e.CreatedAt)
+	stored := *e
+	stored.TargetID = cloneUint(e.TargetID)
+	stored.MessageID = cloneUint(e.MessageID)
+	stored.ExpiresAt = cloneTime(e.ExpiresAt)
+	s.modLog = append(s.modLog, stored)
+	return nil
+}
+
+func (s *memoryStore) ModerationLog(roomID, beforeID uint, limit int) ([]ModerationEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var entries []ModerationEntry
+	for i := len(s.modLog) - 1; i >= 0 && len(entries) < limit; i-- {
+		e := s.modLog[i]
+		if e.RoomID == roomID && (beforeID == 0 || e.ID < beforeID) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// forEachStore runs fn against a fresh store of every driver that works
+// without a server, so the memory store is held to the SQL semantics.
+func forEachStore(t *testing.T, fn func(t *testing.T, s Store)) {
+	t.Run("memory", func(t *testing.T) {
+		fn(t, newMemoryStore())
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		s, err := openStore("sqlite", filepath.Join(t.TempDir(), "chat.db"))
+		if err != nil {
+			t.Fatalf("openStore() error = %v", err)
+		}
+		defer s.Close()
+		fn(t, s)
+	})
+}
+
+func mustCreateUsers(t *testing.T, s Store, names ...string) []User {
+	t.Helper()
+	users := make([]User, 0, len(names))
+	for _, name := range names {
+		u := User{Username: name}
+		if err := s.CreateUser(&u); err != nil {
+			t.Fatalf("CreateUser(%q) error = %v", name, err)
+		}
+		users = append(users, u)
+	}
+	return users
+}
+
+func TestStoreUsers(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		alice := mustCreateUsers(t, s, "alice")[0]
+
+		if err := s.CreateUser(&User{Username: "alice"}); err != errDuplicate {
+			t.Errorf("CreateUser(duplicate) error = %v, want errDuplicate", err)
+		}
+		if _, err := s.UserByName("nobody"); err != errNotFound {
+			t.Errorf("UserByName(unknown) error = %v, want errNotFound", err)
+		}
+
+		got, err := s.UserByID(alice.ID)
+		if err != nil || got.Username != "alice" {
+			t.Errorf("UserByID() = %+v, %v", got, err)
+		}
+	})
+}
+
+func TestStoreConversationMessages(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		users := mustCreateUsers(t, s, "alice", "bob", "carol")
+		alice, bob, carol := users[0], users[1], users[2]
+
+		// Equal timestamps are ordered by ID.
+		ts := time.Now().Add(-time.Minute).Truncate(time.Millisecond)
+		var ids []uint
+		for i, sender := range []User{alice, bob, alice, carol} {
+			receiver := bob
+			if sender.ID == bob.ID {
+				receiver = alice
+			}
+			m := Message{SenderID: sender.ID, ReceiverID: &receiver.ID, Content: "hi", Timestamp: ts.Add(time.Duration(i/2) * time.Second)}
+			if err := s.CreateMessage(&m, []uint{receiver.ID}); err != nil {
+				t.Fatalf("CreateMessage() error = %v", err)
+			}
+			ids = append(ids, m.ID)
+		}
+
+		conv := conversation{PeerID: bob.ID}
+		page, err := s.ConversationMessages(alice.ID, conv, nil, 2)
+		if err != nil {
+			t.Fatalf("ConversationMessages() error = %v", err)
+		}
+		if got := messageIDs(page); !slices.Equal(got, []uint{ids[2], ids[1]}) {
+			t.Errorf("first page = %v, want %v", got, []uint{ids[2], ids[1]})
+		}
+
+		last := page[len(page)-1]
+		page, _ = s.ConversationMessages(alice.ID, conv, &pagePos{Timestamp: last.Timestamp, ID: last.ID}, 2)
+		if got := messageIDs(page); !slices.Equal(got, []uint{ids[0]}) {
+			t.Errorf("second page = %v, want %v", got, []uint{ids[0]})
+		}
+
+		peers, _ := s.DirectPeerIDs(bob.ID)
+		slices.Sort(peers)
+		if !slices.Equal(peers, []uint{alice.ID, carol.ID}) {
+			t.Errorf("DirectPeerIDs() = %v, want %v", peers, []uint{alice.ID, carol.ID})
+		}
+	})
+}
+
+func messageIDs(msgs []Message) []uint {
+	ids := make([]uint, 0, len(msgs))
+	for _, m := range msgs {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+func TestStoreReceipts(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		users := mustCreateUsers(t, s, "alice", "bob")
+		alice, bob := users[0], users[1]
+
+		var ids []uint
+		for i := 0; i < 3; i++ {
+			m := Message{SenderID: alice.ID, ReceiverID: &bob.ID, Content: "hi", Timestamp: time.Now()}
+			if err := s.CreateMessage(&m, []uint{bob.ID}); err != nil {
+				t.Fatalf("CreateMessage() error = %v", err)
+			}
+			ids = append(ids, m.ID)
+		}
+
+		changed, _ := s.MarkReceipts(bob.ID, ids[:2], receiptDelivered, time.Now())
+		slices.Sort(changed)
+		if !slices.Equal(changed, ids[:2]) {
+			t.Errorf("MarkReceipts(delivered) = %v, want %v", changed, ids[:2])
+		}
+		if changed, _ := s.MarkReceipts(bob.ID, ids[:2], receiptDelivered, time.Now()); len(changed) != 0 {
+			t.Errorf("MarkReceipts(again) = %v, want none", changed)
+		}
+		if changed, _ := s.MarkReceipts(bob.ID, ids[1:2], receiptRead, time.Now()); !slices.Equal(changed, ids[1:2]) {
+			t.Errorf("MarkReceipts(read) = %v, want %v", changed, ids[1:2])
+		}
+
+		counts, _ := s.ReceiptCounts(ids)
+		slices.SortFunc(counts, func(a, b receiptCount) int { return int(a.MessageID) - int(b.MessageID) })
+		want := []receiptCount{
+			{MessageID: ids[0], Total: 1, Delivered: 1},
+			{MessageID: ids[1], Total: 1, Delivered: 1, Read: 1},
+			{MessageID: ids[2], Total: 1},
+		}
+		if !slices.Equal(counts, want) {
+			t.Errorf("ReceiptCounts() = %+v, want %+v", counts, want)
+		}
+
+		if after, _ := s.ReceiptsAfter(bob.ID, ids[0], 0); !slices.Equal(after, ids[1:]) {
+			t.Errorf("ReceiptsAfter() = %v, want %v", after, ids[1:])
+		}
+		if latest, _ := s.LatestReceiptID(bob.ID); latest != ids[2] {
+			t.Errorf("LatestReceiptID() = %d, want %d", latest, ids[2])
+		}
+
+		s.StartDevice(DeviceCursor{UserID: bob.ID, Device: "phone", LastMessageID: ids[1]})
+		s.StartDevice(DeviceCursor{UserID: bob.ID, Device: "phone", LastMessageID: 0})
+		s.AdvanceDeviceCursor(bob.ID, "phone", ids[:1], time.Now())
+		if cursor, _ := s.DeviceCursor(bob.ID, "phone"); cursor.LastMessageID != ids[1] {
+			t.Errorf("cursor moved to %d, want it to stay at %d", cursor.LastMessageID, ids[1])
+		}
+		s.AdvanceDeviceCursor(bob.ID, "phone", ids, time.Now())
+		if cursor, _ := s.DeviceCursor(bob.ID, "phone"); cursor.LastMessageID != ids[2] {
+			t.Errorf("cursor at %d, want %d", cursor.LastMessageID, ids[2])
+		}
+
+		// Acks out of order or in part move the cursor only up to the
+		// first message not yet acknowledged.
+		s.StartDevice(DeviceCursor{UserID: bob.ID, Device: "tablet"})
+		s.AdvanceDeviceCursor(bob.ID, "tablet", ids[2:], time.Now())
+		if cursor, _ := s.DeviceCursor(bob.ID, "tablet"); cursor.LastMessageID != 0 {
+			t.Errorf("cursor skipped to %d past unacknowledged messages", cursor.LastMessageID)
+		}
+		s.AdvanceDeviceCursor(bob.ID, "tablet", []uint{ids[1], ids[0]}, time.Now())
+		if cursor, _ := s.DeviceCursor(bob.ID, "tablet"); cursor.LastMessageID != ids[1] {
+			t.Errorf("cursor at %d, want %d", cursor.LastMessageID, ids[1])
+		}
+	})
+}
+
+func TestStoreAttachmentsAndDelete(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		users := mustCreateUsers(t, s, "alice", "bob")
+		alice, bob := users[0], users[1]
+
+		a := Attachment{UploaderID: alice.ID, Key: "blob-1", Filename: "a.png"}
+		if err := s.CreateAttachment(&a); err != nil {
+			t.Fatalf("CreateAttachment() error = %v", err)
+		}
+
+		// Someone else can't send alice's upload.
+		stolen := Message{SenderID: bob.ID, Content: "mine", Timestamp: time.Now(), Attachments: []Attachment{a}}
+		if err := s.CreateMessage(&stolen, nil); err != errInvalidAttachment {
+			t.Errorf("CreateMessage(foreign attachment) error = %v, want errInvalidAttachment", err)
+		}
+
+		m := Message{SenderID: alice.ID, Content: "look", Timestamp: time.Now(), Attachments: []Attachment{a}}
+		if err := s.CreateMessage(&m, nil); err != nil {
+			t.Fatalf("CreateMessage() error = %v", err)
+		}
+		if pending, _ := s.PendingAttachments(alice.ID, []uint{a.ID}); len(pending) != 0 {
+			t.Errorf("attachment still pending after send")
+		}
+
+		reaction := Reaction{MessageID: m.ID, UserID: bob.ID, Emoji: "👍"}
+		if added, _ := s.AddReaction(&reaction); !added {
+			t.Error("AddReaction() = false, want true")
+		}
+		if added, _ := s.AddReaction(&reaction); added {
+			t.Error("AddReaction(duplicate) = true, want false")
+		}
+		if err := s.EditMessage(m.ID, "look again", time.Now()); err != nil {
+			t.Fatalf("EditMessage() error = %v", err)
+		}
+
+		keys, err := s.DeleteMessage(m.ID, time.Now())
+		if err != nil || !slices.Equal(keys, []string{"blob-1"}) {
+			t.Errorf("DeleteMessage() = %v, %v, want [blob-1]", keys, err)
+		}
+		if _, err := s.DeleteMessage(m.ID, time.Now()); err != errNotFound {
+			t.Errorf("DeleteMessage(again) error = %v, want errNotFound", err)
+		}
+		if reactions, _ := s.Reactions([]uint{m.ID}); len(reactions) != 0 {
+			t.Errorf("reactions survived delete: %+v", reactions)
+		}
+		if edits, _ := s.MessageEdits(m.ID); len(edits) != 0 {
+			t.Errorf("earlier versions survived delete: %+v", edits)
+		}
+		if err := s.EditMessage(m.ID, "back", time.Now()); err != errNotFound {
+			t.Errorf("EditMessage(deleted) error = %v, want errNotFound", err)
+		}
+	})
+}
+
+func TestStoreThreadsAndMentions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		alice := mustCreateUsers(t, s, "alice")[0]
+
+		root := Message{SenderID: alice.ID, Content: "root", Timestamp: time.Now()}
+		s.CreateMessage(&root, nil)
+		var replies []Message
+		for _, content := range []string{"one", "two", "three"} {
+			r := Message{SenderID: alice.ID, Content: content, Timestamp: time.Now(), ParentID: &root.ID}
+			s.CreateMessage(&r, nil)
+			replies = append(replies, r)
+		}
+		s.DeleteMessage(replies[2].ID, time.Now())
+
+		if counts, _ := s.ReplyCounts([]uint{root.ID}); counts[root.ID] != 2 {
+			t.Errorf("ReplyCounts() = %v, want 2 live replies", counts)
+		}
+		if latest, _ := s.LatestReplies([]uint{root.ID}); len(latest) != 1 || latest[0].ID != replies[1].ID {
+			t.Errorf("LatestReplies() = %+v, want reply %d", latest, replies[1].ID)
+		}
+
+		mention := Mention{MessageID: root.ID, UserID: alice.ID}
+		if created, _ := s.CreateMention(&mention); !created {
+			t.Error("CreateMention() = false, want true")
+		}
+		if created, _ := s.CreateMention(&Mention{MessageID: root.ID, UserID: alice.ID}); created {
+			t.Error("CreateMention(duplicate) = true, want false")
+		}
+		s.MarkMentionsRead(alice.ID, nil, time.Now())
+		if unread, _ := s.UnreadMentions(alice.ID); unread != 0 {
+			t.Errorf("UnreadMentions() = %d, want 0", unread)
+		}
+	})
+}
+
+func TestStoreSearch(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		users := mustCreateUsers(t, s, "alice", "bob")
+		alice, bob := users[0], users[1]
+
+		room := Room{Name: "private", CreatedBy: alice.ID, CreatedAt: time.Now()}
+		if err := s.CreateRoom(&room); err != nil {
+			t.Fatalf("CreateRoom() error = %v", err)
+		}
+		inRoom := Message{SenderID: alice.ID, RoomID: &room.ID, Content: "Deploy at 5", Timestamp: time.Now()}
+		s.CreateMessage(&inRoom, nil)
+		inLobby := Message{SenderID: alice.ID, Content: "deploy done_100%", Timestamp: time.Now()}
+		s.CreateMessage(&inLobby, nil)
+
+		hits, _ := s.SearchMessages(searchQuery{UserID: alice.ID, Text: "deploy", Limit: 10})
+		if len(hits) != 2 {
+			t.Errorf("member found %d messages, want 2", len(hits))
+		}
+		hits, _ = s.SearchMessages(searchQuery{UserID: bob.ID, Text: "deploy", Limit: 10})
+		if len(hits) != 1 || hits[0].Message.ID != inLobby.ID {
+			t.Errorf("non-member hits = %+v, want only the lobby message", hits)
+		}
+		if got, want := hits[0].Snippet, snippetStart+"deploy"+snippetStop+" done_100%"; got != want {
+			t.Errorf("snippet = %q, want %q", got, want)
+		}
+
+		later := inLobby.Timestamp.Add(time.Second)
+		if hits, _ := s.SearchMessages(searchQuery{UserID: alice.ID, Text: "deploy", Since: &later, Limit: 10}); len(hits) != 0 {
+			t.Errorf("search since a later time found %d messages, want 0", len(hits))
+		}
+
+		// LIKE wildcards in the query are taken literally.
+		if hits, _ := s.SearchMessages(searchQuery{UserID: bob.ID, Text: "e_1", Limit: 10}); len(hits) != 1 {
+			t.Errorf("search for e_1 found %d messages, want 1", len(hits))
+		}
+		if hits, _ := s.SearchMessages(searchQuery{UserID: bob.ID, Text: "y%d", Limit: 10}); len(hits) != 0 {
+			t.Errorf("search for y%%d found %d messages, want 0", len(hits))
+		}
+	})
+}
+
+func TestStoreModeration(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		users := mustCreateUsers(t, s, "alice", "bob")
+		alice, bob := users[0], users[1]
+
+		room := Room{Name: "general", CreatedBy: alice.ID}
+		if err := s.CreateRoom(&room); err != nil {
+			t.Fatalf("CreateRoom() error = %v", err)
+		}
+		if err := s.AddRoomMember(room.ID, bob.ID); err != nil {
+			t.Fatalf("AddRoomMember() error = %v", err)
+		}
+
+		if role, err := s.RoomRole(room.ID, alice.ID); err != nil || role != roleOwner {
+			t.Errorf("RoomRole(creator) = %q, %v, want owner", role, err)
+		}
+		if err := s.SetRoomRole(room.ID, bob.ID, roleModerator); err != nil {
+			t.Fatalf("SetRoomRole() error = %v", err)
+		}
+		members, err := s.RoomMembers(room.ID)
+		if err != nil || len(members) != 2 || members[1].UserID != bob.ID || members[1].Role != roleModerator {
+			t.Errorf("RoomMembers() = %+v, %v, want bob second as moderator", members, err)
+		}
+		if err := s.SetRoomRole(room.ID, 99, roleModerator); err != errNotFound {
+			t.Errorf("SetRoomRole(non-member) error = %v, want errNotFound", err)
+		}
+
+		// Setting a sanction again replaces it.
+		end := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+		for _, expires := range []*time.Time{nil, &end} {
+			if err := s.SetSanction(RoomSanction{RoomID: room.ID, UserID: bob.ID, Kind: sanctionMute, ExpiresAt: expires}); err != nil {
+				t.Fatalf("SetSanction() error = %v", err)
+			}
+		}
+		got, err := s.Sanction(room.ID, bob.ID, sanctionMute)
+		if err != nil || got.ExpiresAt == nil || !got.ExpiresAt.Equal(end) {
+			t.Errorf("Sanction() = %+v, %v, want expiry %v", got, err, end)
+		}
+		if _, err := s.Sanction(room.ID, bob.ID, sanctionBan); err != errNotFound {
+			t.Errorf("Sanction(ban) error = %v, want errNotFound", err)
+		}
+		if removed, err := s.RemoveSanction(room.ID, bob.ID, sanctionMute); err != nil || !removed {
+			t.Errorf("RemoveSanction() = %v, %v, want true", removed, err)
+		}
+
+		for i, id := range []uint{2, 1, 2} {
+			pin := RoomPin{RoomID: room.ID, MessageID: id, PinnedBy: bob.ID, PinnedAt: end.Add(time.Duration(i) * time.Second)}
+			if _, err := s.PinMessage(&pin); err != nil {
+				t.Fatalf("PinMessage() error = %v", err)
+			}
+		}
+		pins, _ := s.RoomPins(room.ID)
+		if len(pins) != 2 || pins[0].MessageID != 2 {
+			t.Errorf("RoomPins() = %+v, want 2 then 1", pins)
+		}
+		if removed, _ := s.UnpinMessage(room.ID, 2); !removed {
+			t.Error("UnpinMessage() = false, want true")
+		}
+
+		for _, action := range []string{actionMute, actionUnmute, actionPin} {
+			if err := s.AppendModerationLog(&ModerationEntry{RoomID: room.ID, ActorID: bob.ID, Action: action, TargetID: &alice.ID}); err != nil {
+				t.Fatalf("AppendModerationLog() error = %v", err)
+			}
+		}
+		entries, err := s.ModerationLog(room.ID, 0, 2)
+		if err != nil || len(entries) != 2 || entries[0].Action != actionPin || entries[1].Action != actionUnmute {
+			t.Fatalf("ModerationLog() = %+v, %v, want pin then unmute", entries, err)
+		}
+		older, _ := s.ModerationLog(room.ID, entries[1].ID, 10)
+		if len(older) != 1 || older[0].Action != actionMute || *older[0].TargetID != alice.ID {
+			t.Errorf("ModerationLog(before) = %+v, want the mute", older)
+		}
+	})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Reply previews pushed to thread viewers are cut to this many runes.
+const threadPreviewLength = 100
+
+type threadSummary struct {
+	ReplyCount  int           `json:"reply_count"`
+	LatestReply *replyPreview `json:"latest_reply,omitempty"`
+}
+
+type replyPreview struct {
+	ID        uint      `json:"id"`
+	Sender    string    `json:"sender"`
+	Content   string    `json:"content"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// summarizeThreads counts the live replies to each message and previews the
+// newest one. Messages without replies are left out.
+func summarizeThreads(messageIDs []uint) map[uint]*threadSummary {
+	summaries := make(map[uint]*threadSummary)
+	if len(messageIDs) == 0 {
+		return summaries
+	}
+
+	counts, _ := store.ReplyCounts(messageIDs)
+	if len(counts) == 0 {
+		return summaries
+	}
+
+	for parentID, count := range counts {
+		summaries[parentID] = &threadSummary{ReplyCount: count}
+	}
+
+	latest, _ := store.LatestReplies(messageIDs)
+	senderIDs := make([]uint, 0, len(latest))
+	for _, l := range latest {
+		senderIDs = append(senderIDs, l.SenderID)
+	}
+	names := usernamesByID(senderIDs)
+
+	for _, l := range latest {
+		if s := summaries[*l.ParentID]; s != nil {
+			s.LatestReply = &replyPreview{
+				ID:        l.ID,
+				Sender:    names[l.SenderID],
+				Content:   preview(l.Content),
+				Timestamp: l.Timestamp,
+			}
+		}
+	}
+	return summaries
+}
+
+func preview(content string) string {
+	runes := []rune(content)
+	if len(runes) <= threadPreviewLength {
+		return content
+	}
+	return string(runes[:threadPreviewLength]) + "…"
+}
+
+// resolveThread loads the message being replied to and returns the top of
+// its thread; replies to replies join the same thread.
+func resolveThread(client *Client, parentID uint) (Message, bool) {
+	parent, err := store.Message(parentID)
+	if err != nil || !canViewMessage(client.UserID, parent) {
+		sendError(client, "unknown_message", "Message does not exist")
+		return parent, false
+	}
+
+	if parent.ParentID != nil {
+		if parent, err = store.Message(*parent.ParentID); err != nil {
+			sendError(client, "unknown_message", "Message does not exist")
+			return parent, false
+		}
+	}
+
+	if parent.DeletedAt != nil {
+		sendError(client, "message_deleted", "Message was deleted")
+		return parent, false
+	}
+	return parent, true
+}
+
+// threadTarget returns where a reply to root must be delivered: root's room,
+// or the other side of root's direct conversation.
+func threadTarget(client *Client, root Message) (roomID uint, recipient string) {
+	switch {
+	case root.RoomID != nil:
+		return *root.RoomID, ""
+	case root.ReceiverID != nil:
+		peerID := *root.ReceiverID
+		if peerID == client.UserID {
+			peerID = root.SenderID
+		}
+		peer, _ := store.UserByID(peerID)
+		return 0, peer.Username
+	default:
+		return 0, ""
+	}
+}
+
+// pushThreadUpdate sends the current reply count and latest reply of a
+// thread to everyone who can see its first message.
+func pushThreadUpdate(parentID uint) {
+	parent, err := store.Message(parentID)
+	if err != nil {
+		return
+	}
+
+	summary := summarizeThreads([]uint{parentID})[parentID]
+	if summary == nil {
+		summary = &threadSummary{}
+	}
+
+	broadcastToAudience(parent, threadUpdatedEvent{ID: parent.ID, Thread: summary, Room: derefID(parent.RoomID)})
+}
+
+// ================= THREAD HANDLER =================
+
+// threadHandler serves GET /messages/{id}/thread?before=&limit=: the first
+// message of the thread and a page of its replies, oldest first.
+func threadHandler(w http.ResponseWriter, r *http.Request, user User) {
+	id, ok := messageIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	parent, err := store.Message(id)
+	if err != nil || !canViewMessage(user.ID, parent) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	if parent.ParentID != nil {
+		http.Error(w, "Message is a reply; fetch its parent's thread", http.StatusBadRequest)
+		return
+	}
+
+	limit := historyDefaultLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, historyMaxLimit)
+	}
+
+	before := r.URL.Query().Get("before")
+	if before != "" {
+		if _, _, err := decodeCursor(before); err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	replies, hasMore, err := loadMessages(user.ID, conversation{ThreadID: parent.ID}, before, limit)
+	if err != nil {
+		http.Error(w, "Could not load thread", http.StatusInternalServerError)
+		return
+	}
+
+	resp := struct {
+		Parent     messageView   `json:"parent"`
+		Replies    []messageView `json:"replies"`
+		NextCursor string        `json:"next_cursor,omitempty"`
+	}{
+		Parent:  toMessageViews(user.ID, []Message{parent})[0],
+		Replies: toMessageViews(user.ID, replies),
+	}
+	if hasMore {
+		resp.NextCursor = encodeCursor(replies[0])
+	}
+
+	json.NewEncoder(w).Encode(resp)
+}
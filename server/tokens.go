@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const refreshTokenTTL = 30 * 24 * time.Hour
+
+// RefreshToken is a single-use token that can be exchanged for a new access
+// token. Every exchange rotates it within the same family; presenting a token
+// that was already used revokes the whole family.
+type RefreshToken struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"index;not null"`
+	Family    string `gorm:"index;not null"`
+	TokenHash string `gorm:"uniqueIndex;not null"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	RevokedAt *time.Time
+	CreatedAt time.Time
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken is what gets stored, so a database leak doesn't hand out live
+// refresh tokens.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueRefreshToken stores a new refresh token for user. An empty family
+// starts a new login session.
+func issueRefreshToken(userID uint, family string) (string, string, error) {
+	if family == "" {
+		var err error
+		if family, err = randomToken(); err != nil {
+			return "", "", err
+		}
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	err = store.CreateRefreshToken(&RefreshToken{
+		UserID:    userID,
+		Family:    family,
+		TokenHash: hashToken(token),
+		ExpiresAt: time.Now().Add(refreshTokenTTL),
+	})
+	return token, family, err
+}
+
+// writeTokens issues an access/refresh token pair and writes it as the
+// response body.
+func writeTokens(w http.ResponseWriter, status int, user User, family string) {
+	refresh, family, err := issueRefreshToken(user.ID, family)
+	if err != nil {
+		http.Error(w, "Token generation failed", 500)
+		return
+	}
+
+	access, expires, err := generateJWT(user.Username, family)
+	if err != nil {
+		http.Error(w, "Token generation failed", 500)
+		return
+	}
+
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":         access,
+		"refresh_token": refresh,
+		"expires_in":    int(time.Until(expires).Seconds()),
+	})
+}
+
+func familyRevoked(family string) bool {
+	if family == "" {
+		return true
+	}
+
+	revoked, _ := store.FamilyRevoked(family)
+	return revoked
+}
+
+// revokeFamily invalidates every refresh token of a login session and drops
+// the websocket connections that were opened with it.
+func revokeFamily(family string) {
+	store.RevokeFamily(family, time.Now())
+	disconnectFamily(family, "token revoked")
+}
+
+// ================= TOKEN HANDLERS =================
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+func refreshHandler(w http.ResponseWriter, r *http.Request) {
+	var req refreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	stored, err := store.RefreshTokenByHash(hashToken(req.RefreshToken))
+	if err != nil {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	if stored.RevokedAt != nil {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	if stored.UsedAt != nil {
+		// A rotated token came back: someone else holds a copy.
+		log.Printf("refresh token reuse detected for user %d, revoking session", stored.UserID)
+		revokeFamily(stored.Family)
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	if time.Now().After(stored.ExpiresAt) {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	// Mark as used only if nobody beat us to it, so two concurrent refreshes
+	// with the same token can't both succeed.
+	used, err := store.UseRefreshToken(stored.ID, time.Now())
+	if err != nil {
+		http.Error(w, "Token refresh failed", http.StatusInternalServerError)
+		return
+	}
+	if !used {
+		revokeFamily(stored.Family)
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := store.UserByID(stored.UserID)
+	if err != nil {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	writeTokens(w, http.StatusOK, user, stored.Family)
+}
+
+// logoutHandler revokes the refresh family of the presented token. It always
+// succeeds so it can't be used to probe for valid tokens.
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	var req refreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if stored, err := store.RefreshTokenByHash(hashToken(req.RefreshToken)); err == nil {
+		revokeFamily(stored.Family)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ================= SESSION EXPIRY =================
+
+// extendSession (re)arms the timer that closes the connection once its
+// access token expires.
+func (c *Client) extendSession(expires time.Time) {
+	if c.expiry == nil {
+		c.expiry = time.AfterFunc(time.Until(expires), func() {
+			c.disconnect("token expired")
+		})
+		return
+	}
+	c.expiry.Reset(time.Until(expires))
+}
+
+// disconnect closes the connection because its credentials are no longer
+// good.
+func (c *Client) disconnect(reason string) {
+	c.closeWith(closeUnauthorized, reason)
+}
+
+// closeWith sends a close frame and closes the connection. WriteControl and
+// Close are safe to call alongside the reader and writers.
+func (c *Client) closeWith(code int, reason string) {
+	if c.stream != nil {
+		c.stream.stop(code, reason)
+		return
+	}
+
+	msg := websocket.FormatCloseMessage(code, reason)
+	c.Conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	c.Conn.Close()
+}
+
+// disconnectFamily closes every session opened with a token of family, on
+// this node and the others.
+func disconnectFamily(family, reason string) {
+	hub.publish(busEvent{Kind: busDisconnect, Family: family, Reason: reason})
+
+	var matched []*Client
+	hub.do(func(clients map[*Client]bool) {
+		for c := range clients {
+			if c.Family == family {
+				matched = append(matched, c)
+			}
+		}
+	})
+
+	for _, c := range matched {
+		c.disconnect(reason)
+	}
+}
+
+// handleReauth lets a connected client present a freshly refreshed access
+// token so the session outlives the token it was opened with.
+func handleReauth(client *Client, token string) {
+	claims, err := validateJWT(token)
+	if err != nil || claims.Username != client.Username {
+		client.disconnect("invalid token")
+		return
+	}
+
+	hub.do(func(map[*Client]bool) {
+		client.Family = claims.Family
+	})
+
+	client.extendSession(claims.ExpiresAt.Time)
+}
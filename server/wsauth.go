@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Close codes in the 4000-4999 range are ours to define. They mirror the
+// HTTP status a request would have got.
+const (
+	closeBadRequest   = 4000
+	closeUnauthorized = 4001
+	closeAuthTimeout  = 4008
+)
+
+// tokenSubprotocol prefixes an access token offered as a websocket
+// subprotocol. Browsers can't set headers on an upgrade, so they offer
+// "chat.v1" and "bearer.<token>"; only chat.v1 is ever selected.
+const tokenSubprotocol = "bearer."
+
+// accessTokenCookie may carry the access token on an upgrade instead. The
+// upgrader's origin check keeps other sites from riding on it.
+const accessTokenCookie = "access_token"
+
+// authTimeout is how long a socket that presented no token with its upgrade
+// has to send its auth frame. It is a variable so tests can shorten it.
+var authTimeout = 10 * time.Second
+
+// upgradeToken returns the access token presented with a websocket upgrade
+// in the Authorization header, a token subprotocol or the access token
+// cookie, or "" if there is none.
+func upgradeToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	for _, protocol := range websocket.Subprotocols(r) {
+		if token, ok := strings.CutPrefix(protocol, tokenSubprotocol); ok {
+			return token
+		}
+	}
+	if cookie, err := r.Cookie(accessTokenCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestUpgradeToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   string
+	}{
+		{"none", http.Header{}, ""},
+		{"authorization", http.Header{"Authorization": {"Bearer abc"}}, "abc"},
+		{"subprotocol", http.Header{"Sec-Websocket-Protocol": {"chat.v1, bearer.abc"}}, "abc"},
+		{"cookie", http.Header{"Cookie": {"access_token=abc"}}, "abc"},
+		{"other scheme", http.Header{"Authorization": {"Basic abc"}}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/ws", nil)
+			r.Header = tt.header
+			if got := upgradeToken(r); got != tt.want {
+				t.Errorf("upgradeToken() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpgradeAuth(t *testing.T) {
+	resetStore(t)
+	srv := httptest.NewServer(routes())
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	// dial connects and returns the close code the server ends the
+	// session with, or 0 once it is registered. Each successful session
+	// needs its own user to be announced.
+	dial := func(t *testing.T, dialer websocket.Dialer, header http.Header) int {
+		t.Helper()
+		conn, _, err := dialer.Dial(url, header)
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		defer conn.Close()
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			var frame map[string]interface{}
+			err := conn.ReadJSON(&frame)
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) {
+				return closeErr.Code
+			}
+			if err != nil {
+				t.Fatalf("ReadJSON() error = %v", err)
+			}
+			if content, _ := frame["content"].(string); strings.HasSuffix(content, " joined the chat") {
+				return 0
+			}
+		}
+	}
+
+	t.Run("authorization header", func(t *testing.T) {
+		_, tokens := register(t, "alice")
+		header := http.Header{"Authorization": {"Bearer " + tokens.Token}}
+		if code := dial(t, websocket.Dialer{}, header); code != 0 {
+			t.Errorf("closed with %d, want a session", code)
+		}
+	})
+
+	t.Run("subprotocol", func(t *testing.T) {
+		_, tokens := register(t, "bob")
+		dialer := websocket.Dialer{Subprotocols: []string{"bearer." + tokens.Token}}
+		if code := dial(t, dialer, nil); code != 0 {
+			t.Errorf("closed with %d, want a session", code)
+		}
+	})
+
+	t.Run("cookie", func(t *testing.T) {
+		_, tokens := register(t, "carol")
+		header := http.Header{"Cookie": {accessTokenCookie + "=" + tokens.Token}}
+		if code := dial(t, websocket.Dialer{}, header); code != 0 {
+			t.Errorf("closed with %d, want a session", code)
+		}
+	})
+
+	t.Run("invalid token", func(t *testing.T) {
+		header := http.Header{"Authorization": {"Bearer nope"}}
+		if code := dial(t, websocket.Dialer{}, header); code != closeUnauthorized {
+			t.Errorf("closed with %d, want %d", code, closeUnauthorized)
+		}
+	})
+
+	t.Run("no auth frame", func(t *testing.T) {
+		defer func(d time.Duration) { authTimeout = d }(authTimeout)
+		authTimeout = 50 * time.Millisecond
+
+		if code := dial(t, websocket.Dialer{}, nil); code != closeAuthTimeout {
+			t.Errorf("closed with %d, want %d", code, closeAuthTimeout)
+		}
+	})
+}